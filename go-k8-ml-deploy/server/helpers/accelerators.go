@@ -0,0 +1,186 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	VendorNvidia = "nvidia"
+	VendorAmd    = "amd"
+)
+
+var migProfile = regexp.MustCompile(`^[0-9]+g\.[0-9]+gb$`)
+
+// Accelerator asks for whole accelerator units. Pool names one of the
+// accelerator pools in the server config, which supplies the resource name,
+// node selector and tolerations. Without a pool the resource name is derived
+// from Vendor, Mig_profile and Shared, or given directly as Resource.
+type Accelerator struct {
+	Pool        string `json:"pool"`
+	Vendor      string `json:"vendor"`
+	Resource    string `json:"resource"`
+	Mig_profile string `json:"mig_profile"`
+	Shared      bool   `json:"shared"`
+	Count       *int   `json:"count"`
+
+	nodeSelector map[string]string
+	tolerations  []apiv1.Toleration
+}
+
+// AcceleratorPool describes a group of accelerator nodes in the config.
+type AcceleratorPool struct {
+	Resource      string             `json:"resource"`
+	Node_selector map[string]string  `json:"node_selector"`
+	Tolerations   []apiv1.Toleration `json:"tolerations"`
+}
+
+// vendorResource derives the extended resource name from the vendor, MIG
+// profile and time-slicing settings, following the naming of the NVIDIA
+// and AMD device plugins.
+func (accelerator *Accelerator) vendorResource() (string, *APIError) {
+
+	switch accelerator.Vendor {
+	case "", VendorNvidia:
+		if accelerator.Mig_profile != "" && accelerator.Shared {
+			return "", fieldError("accelerator.shared", "MIG profiles cannot be time-sliced")
+		}
+		if accelerator.Mig_profile != "" {
+			if !migProfile.MatchString(accelerator.Mig_profile) {
+				return "", fieldError("accelerator.mig_profile", fmt.Sprintf(
+					"%q is not a MIG profile such as 1g.5gb", accelerator.Mig_profile,
+				))
+			}
+			return "nvidia.com/mig-" + accelerator.Mig_profile, nil
+		}
+		if accelerator.Shared {
+			return "nvidia.com/gpu.shared", nil
+		}
+		return "nvidia.com/gpu", nil
+	case VendorAmd:
+		if accelerator.Mig_profile != "" || accelerator.Shared {
+			return "", fieldError("accelerator.vendor", "MIG profiles and time-slicing are NVIDIA only")
+		}
+		return "amd.com/gpu", nil
+	}
+
+	return "", fieldError("accelerator.vendor", fmt.Sprintf(
+		"unknown vendor %q, use %s or %s", accelerator.Vendor, VendorNvidia, VendorAmd,
+	))
+}
+
+// ResolveAccelerator validates the accelerator of a model and works out the
+// resource name and scheduling constraints it needs. The legacy limits.gpu
+// and requests.gpu fields are read as a whole-unit NVIDIA GPU count, where 0
+// means no GPU, and cannot be combined with an accelerator.
+func (config *ServerConfig) ResolveAccelerator(model *ModelDeploy) error {
+
+	var count *int
+	legacy := []struct {
+		field string
+		count *int
+	}{
+		{"limits.gpu", model.Limits.Gpu},
+		{"requests.gpu", model.Requests.Gpu},
+	}
+	for _, gpu := range legacy {
+		if gpu.count == nil || *gpu.count == 0 {
+			continue
+		}
+		if *gpu.count < 0 {
+			return fieldError(gpu.field, "must not be negative")
+		}
+		if model.Accelerator != nil {
+			return fieldError(gpu.field, "cannot be combined with accelerator, set accelerator.count instead")
+		}
+		if count == nil {
+			count = gpu.count
+		}
+	}
+
+	if model.Accelerator == nil {
+		if count == nil {
+			return nil
+		}
+		model.Accelerator = &Accelerator{Count: count}
+	}
+
+	accelerator := model.Accelerator
+
+	if accelerator.Count == nil || *accelerator.Count < 1 {
+		return fieldError("accelerator.count", "must be a whole number of at least 1")
+	}
+
+	if accelerator.Pool != "" {
+		pool, ok := config.Accelerators[accelerator.Pool]
+		if !ok {
+			return fieldError("accelerator.pool", fmt.Sprintf("unknown accelerator pool %q", accelerator.Pool))
+		}
+		if accelerator.Resource == "" {
+			accelerator.Resource = pool.Resource
+		}
+		accelerator.nodeSelector = pool.Node_selector
+		accelerator.tolerations = pool.Tolerations
+	}
+
+	if accelerator.Resource == "" {
+		name, apiErr := accelerator.vendorResource()
+		if apiErr != nil {
+			return apiErr
+		}
+		accelerator.Resource = name
+	} else if !strings.Contains(accelerator.Resource, "/") {
+		return fieldError("accelerator.resource", fmt.Sprintf(
+			"%q is not an extended resource name such as nvidia.com/gpu", accelerator.Resource,
+		))
+	}
+
+	// Accelerator nodes are usually tainted with their resource name, so
+	// tolerate that when the pool does not say otherwise.
+	if accelerator.tolerations == nil {
+		accelerator.tolerations = []apiv1.Toleration{
+			{
+				Key:      accelerator.Resource,
+				Operator: apiv1.TolerationOpExists,
+				Effect:   apiv1.TaintEffectNoSchedule,
+			},
+		}
+	}
+
+	return nil
+}
+
+// addTo sets the accelerator count on a ResourceList. Extended resources
+// cannot be overcommitted, so requests and limits always get the same count.
+func (accelerator *Accelerator) addTo(list apiv1.ResourceList) apiv1.ResourceList {
+
+	if accelerator == nil || accelerator.Count == nil || accelerator.Resource == "" {
+		return list
+	}
+
+	if list == nil {
+		list = apiv1.ResourceList{}
+	}
+	list[apiv1.ResourceName(accelerator.Resource)] = *resource.NewQuantity(int64(*accelerator.Count), resource.DecimalSI)
+
+	return list
+}
+
+func (accelerator *Accelerator) podNodeSelector() map[string]string {
+	if accelerator == nil {
+		return nil
+	}
+	return accelerator.nodeSelector
+}
+
+func (accelerator *Accelerator) podTolerations() []apiv1.Toleration {
+	if accelerator == nil {
+		return nil
+	}
+	return accelerator.tolerations
+}
@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResolveAccelerator(t *testing.T) {
+
+	config := &ServerConfig{
+		Accelerators: map[string]AcceleratorPool{
+			"a100": {Resource: "nvidia.com/gpu", Node_selector: map[string]string{"pool": "a100"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		resource string
+		count    int
+		fields   []string
+	}{
+		{"none", `{}`, "", 0, nil},
+		{"legacy gpu", `{"limits": {"gpu": 2}}`, "nvidia.com/gpu", 2, nil},
+		{"legacy request gpu", `{"requests": {"gpu": 1}}`, "nvidia.com/gpu", 1, nil},
+		{"legacy gpu of 0", `{"limits": {"gpu": 0}, "requests": {"gpu": 0}}`, "", 0, nil},
+		{"legacy gpu of 0 with accelerator", `{"limits": {"gpu": 0}, "accelerator": {"count": 1}}`, "nvidia.com/gpu", 1, nil},
+		{"negative legacy gpu", `{"limits": {"gpu": -1}}`, "", 0, []string{"limits.gpu"}},
+		{"legacy gpu with accelerator", `{"requests": {"gpu": 1}, "accelerator": {"count": 1}}`, "", 0, []string{"requests.gpu"}},
+		{"amd", `{"accelerator": {"vendor": "amd", "count": 1}}`, "amd.com/gpu", 1, nil},
+		{"mig", `{"accelerator": {"mig_profile": "1g.5gb", "count": 1}}`, "nvidia.com/mig-1g.5gb", 1, nil},
+		{"shared", `{"accelerator": {"shared": true, "count": 1}}`, "nvidia.com/gpu.shared", 1, nil},
+		{"pool", `{"accelerator": {"pool": "a100", "count": 4}}`, "nvidia.com/gpu", 4, nil},
+		{"explicit resource", `{"accelerator": {"resource": "example.com/tpu", "count": 1}}`, "example.com/tpu", 1, nil},
+		{"no count", `{"accelerator": {"vendor": "nvidia"}}`, "", 0, []string{"accelerator.count"}},
+		{"unknown pool", `{"accelerator": {"pool": "h100", "count": 1}}`, "", 0, []string{"accelerator.pool"}},
+		{"unknown vendor", `{"accelerator": {"vendor": "intel", "count": 1}}`, "", 0, []string{"accelerator.vendor"}},
+		{"bad mig profile", `{"accelerator": {"mig_profile": "half", "count": 1}}`, "", 0, []string{"accelerator.mig_profile"}},
+		{"shared mig", `{"accelerator": {"mig_profile": "1g.5gb", "shared": true, "count": 1}}`, "", 0, []string{"accelerator.shared"}},
+		{"amd mig", `{"accelerator": {"vendor": "amd", "mig_profile": "1g.5gb", "count": 1}}`, "", 0, []string{"accelerator.vendor"}},
+		{"bare resource", `{"accelerator": {"resource": "gpu", "count": 1}}`, "", 0, []string{"accelerator.resource"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := new(ModelDeploy)
+			if err := json.Unmarshal([]byte(test.body), model); err != nil {
+				t.Fatal(err)
+			}
+
+			err := config.ResolveAccelerator(model)
+			checkFields(t, err, test.fields)
+			if err != nil {
+				return
+			}
+
+			if test.resource == "" {
+				if model.Accelerator != nil {
+					t.Errorf("accelerator = %+v, want none", model.Accelerator)
+				}
+				return
+			}
+			if model.Accelerator == nil {
+				t.Fatalf("accelerator is not set")
+			}
+			if model.Accelerator.Resource != test.resource || *model.Accelerator.Count != test.count {
+				t.Errorf("accelerator = %d %s, want %d %s",
+					*model.Accelerator.Count, model.Accelerator.Resource, test.count, test.resource)
+			}
+			if len(model.Accelerator.podTolerations()) == 0 {
+				t.Errorf("accelerator has no tolerations")
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// FieldManager is the server-side apply field manager every write of this
+// server is made under.
+const FieldManager = "go-k8-ml-deploy"
+
+// legacyFieldManagers owned the objects this server wrote with Create and
+// Update before it used server-side apply. Their fields are taken over
+// without asking for force_conflicts.
+var legacyFieldManagers = []string{
+	strings.SplitN(rest.DefaultKubernetesUserAgent(), "/", 2)[0],
+}
+
+type FieldConflict struct {
+	Field   string
+	Manager string
+	Message string
+}
+
+// ApplyConflict is returned when an apply would change fields that another
+// field manager owns.
+type ApplyConflict struct {
+	Kind      string
+	Name      string
+	Conflicts []FieldConflict
+	err       error
+}
+
+func (conflict *ApplyConflict) Error() string {
+	fields := make([]string, 0, len(conflict.Conflicts))
+	for _, field := range conflict.Conflicts {
+		fields = append(fields, fmt.Sprintf("%s (%s)", field.Field, field.Manager))
+	}
+	return fmt.Sprintf(
+		"%s %s: fields owned by other managers: %s; set force_conflicts to take ownership",
+		conflict.Kind, conflict.Name, strings.Join(fields, ", "),
+	)
+}
+
+func (conflict *ApplyConflict) Unwrap() error {
+	return conflict.err
+}
+
+// conflictManager pulls the manager name out of a conflict cause such as
+// `conflict with "kubectl" using apps/v1`.
+func conflictManager(message string) string {
+	quoted := strings.TrimPrefix(message, "conflict with ")
+	prefix, err := strconv.QuotedPrefix(quoted)
+	if err != nil {
+		return quoted
+	}
+	manager, err := strconv.Unquote(prefix)
+	if err != nil {
+		return quoted
+	}
+	return manager
+}
+
+func newApplyConflict(kind, name string, err error) *ApplyConflict {
+
+	var status apierrors.APIStatus
+	if !apierrors.IsConflict(err) || !errors.As(err, &status) {
+		return nil
+	}
+
+	conflict := &ApplyConflict{Kind: kind, Name: name, Conflicts: make([]FieldConflict, 0), err: err}
+
+	if details := status.Status().Details; details != nil {
+		for _, cause := range details.Causes {
+			if cause.Type != metav1.CauseTypeFieldManagerConflict {
+				continue
+			}
+			conflict.Conflicts = append(conflict.Conflicts, FieldConflict{
+				Field:   cause.Field,
+				Manager: conflictManager(cause.Message),
+				Message: cause.Message,
+			})
+		}
+	}
+
+	return conflict
+}
+
+// replicasField is written by the HPA through the scale subresource. A
+// request that turns autoscaling off takes it over with its fixed count.
+const replicasField = ".spec.replicas"
+
+// takenOver reports whether every conflict is one this server resolves by
+// itself: fields of the legacy field manager, and the replicas of a model
+// with a fixed replica count.
+func (conflict *ApplyConflict) takenOver(model *ModelDeploy) bool {
+
+	if len(conflict.Conflicts) == 0 {
+		return false
+	}
+
+	for _, field := range conflict.Conflicts {
+		owned := field.Field == replicasField && model.replicas() != nil
+		for _, manager := range legacyFieldManagers {
+			if field.Manager == manager {
+				owned = true
+			}
+		}
+		if !owned {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ownsApply reports whether this server has applied the object before, as
+// opposed to having created it with a plain Create.
+func ownsApply(object metav1.Object) bool {
+	for _, entry := range object.GetManagedFields() {
+		if entry.Manager == FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			return true
+		}
+	}
+	return false
+}
+
+// applyObject server-side applies object through patch. Only the fields set
+// on object are claimed, so fields owned by other controllers (a Service
+// clusterIP, replicas set by an HPA) are left alone.
+func applyObject(
+	ctx context.Context,
+	kind, name string,
+	object interface{},
+	model *ModelDeploy,
+	patch func(ctx context.Context, data []byte, options metav1.PatchOptions) error,
+) error {
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	force := model.Force_conflicts
+	options := metav1.PatchOptions{FieldManager: FieldManager, Force: &force, DryRun: model.dryRun()}
+
+	err = patch(ctx, data, options)
+	if err == nil {
+		return nil
+	}
+
+	conflict := newApplyConflict(kind, name, err)
+	if conflict == nil {
+		return err
+	}
+
+	if !force && conflict.takenOver(model) {
+		fmt.Printf("Taking over %s %q from the previous field managers.\n", strings.ToLower(kind), name)
+		force = true
+		options.Force = &force
+		return patch(ctx, data, options)
+	}
+
+	return conflict
+}
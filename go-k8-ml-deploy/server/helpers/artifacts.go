@@ -0,0 +1,236 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultArtifactPath  = "/models"
+	defaultArtifactImage = "amazon/aws-cli:2.15.0"
+	artifactVolume       = "model-artifacts"
+)
+
+var sha256Digest = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// downloadScript copies an S3 object, or every object under a prefix ending
+// in /, into ARTIFACT_DIR and checks the sha256 of single objects. The source
+// is passed through the environment so it is never interpreted by the shell.
+const downloadScript = `set -eu
+mkdir -p "$ARTIFACT_DIR"
+case "$ARTIFACT_URI" in
+*/)
+  aws s3 cp --recursive --only-show-errors "$ARTIFACT_URI" "$ARTIFACT_DIR/"
+  ;;
+*)
+  target="$ARTIFACT_DIR/$(basename "$ARTIFACT_URI")"
+  aws s3 cp --only-show-errors "$ARTIFACT_URI" "$target"
+  if [ -n "${ARTIFACT_SHA256:-}" ]; then
+    echo "$ARTIFACT_SHA256  $target" | sha256sum -c -
+  fi
+  ;;
+esac
+`
+
+// ArtifactSource is one model artifact, made available under
+// <mount_path>/<name>. It is either downloaded from an S3 compatible store
+// (Uri, with Endpoint_url for MinIO and the AWS_* keys of
+// Credentials_secret), or mounted from an existing PVC or volume.
+type ArtifactSource struct {
+	Name               string              `json:"name"`
+	Uri                string              `json:"uri"`
+	Endpoint_url       string              `json:"endpoint_url"`
+	Credentials_secret string              `json:"credentials_secret"`
+	Sha256             string              `json:"sha256"`
+	Pvc                string              `json:"pvc"`
+	Volume             *apiv1.VolumeSource `json:"volume"`
+	Sub_path           string              `json:"sub_path"`
+}
+
+// Artifacts are mounted read-only into the model container at Mount_path.
+// Downloads go to an emptyDir, capped at Size_limit, unless Download_pvc
+// names a claim to keep them in.
+type Artifacts struct {
+	Mount_path   string             `json:"mount_path"`
+	Download_pvc string             `json:"download_pvc"`
+	Size_limit   *resource.Quantity `json:"size_limit"`
+	Sources      []ArtifactSource   `json:"sources"`
+
+	image string
+}
+
+func (artifacts *Artifacts) mountPath() string {
+	if artifacts.Mount_path != "" {
+		return artifacts.Mount_path
+	}
+	return defaultArtifactPath
+}
+
+func (source ArtifactSource) downloaded() bool {
+	return source.Uri != ""
+}
+
+// ResolveArtifacts validates the artifact sources of a model and picks the
+// image of the download init containers from the config.
+func (config *ServerConfig) ResolveArtifacts(model *ModelDeploy) error {
+
+	artifacts := model.Artifacts
+	if artifacts == nil {
+		return nil
+	}
+
+	invalid := make([]*APIError, 0)
+	names := make(map[string]bool)
+
+	if !strings.HasPrefix(artifacts.mountPath(), "/") {
+		invalid = append(invalid, fieldError("artifacts.mount_path", "must be an absolute path"))
+	}
+
+	for i, source := range artifacts.Sources {
+		field := fmt.Sprintf("artifacts.sources[%d]", i)
+
+		// Volume and init container names are derived from the source name.
+		if errs := validation.IsDNS1123Label(source.Name); len(errs) > 0 || len(source.Name) > 50 {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf(
+				"%q must be a lowercase DNS label of at most 50 characters", source.Name,
+			)))
+		}
+		if names[source.Name] {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf("%q is used twice", source.Name)))
+		}
+		names[source.Name] = true
+
+		kinds := 0
+		for _, set := range []bool{source.Uri != "", source.Pvc != "", source.Volume != nil} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			invalid = append(invalid, fieldError(field, "set exactly one of uri, pvc or volume"))
+			continue
+		}
+
+		if !source.downloaded() {
+			if source.Sha256 != "" || source.Endpoint_url != "" || source.Credentials_secret != "" {
+				invalid = append(invalid, fieldError(field, "sha256, endpoint_url and credentials_secret need uri"))
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(source.Uri, "s3://") {
+			invalid = append(invalid, fieldError(field+".uri", fmt.Sprintf("%q is not an s3:// URI", source.Uri)))
+		}
+		if source.Sha256 != "" {
+			if strings.HasSuffix(source.Uri, "/") {
+				invalid = append(invalid, fieldError(field+".sha256", "checksums are only checked for single objects"))
+			} else if !sha256Digest.MatchString(source.Sha256) {
+				invalid = append(invalid, fieldError(field+".sha256", "must be 64 lowercase hex characters"))
+			}
+		}
+	}
+
+	if len(invalid) > 0 {
+		apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid artifact fields", len(invalid)))
+		apiErr.Errors = invalid
+		return apiErr
+	}
+
+	artifacts.image = config.Artifact_image
+	if artifacts.image == "" {
+		artifacts.image = defaultArtifactImage
+	}
+
+	return nil
+}
+
+// applyArtifacts adds the artifact volumes, one download init container per
+// S3 source and the read-only mounts of the model container, one per source
+// under the mount path.
+func (model *ModelDeploy) applyArtifacts(spec *apiv1.PodSpec, container *apiv1.Container) {
+
+	artifacts := model.Artifacts
+	if artifacts == nil || len(artifacts.Sources) == 0 {
+		return
+	}
+
+	mountPath := artifacts.mountPath()
+	container.Env = append(container.Env, apiv1.EnvVar{Name: "ARTIFACTS_PATH", Value: mountPath})
+
+	downloads := false
+	for _, source := range artifacts.Sources {
+		if source.downloaded() {
+			downloads = true
+		}
+	}
+
+	if downloads {
+		volume := apiv1.Volume{Name: artifactVolume}
+		if artifacts.Download_pvc != "" {
+			volume.PersistentVolumeClaim = &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: artifacts.Download_pvc}
+		} else {
+			volume.EmptyDir = &apiv1.EmptyDirVolumeSource{SizeLimit: artifacts.Size_limit}
+		}
+		spec.Volumes = append(spec.Volumes, volume)
+	}
+
+	for _, source := range artifacts.Sources {
+		target := strings.TrimSuffix(mountPath, "/") + "/" + source.Name
+
+		if !source.downloaded() {
+			volume := apiv1.Volume{Name: "artifact-" + source.Name}
+			if source.Pvc != "" {
+				volume.PersistentVolumeClaim = &apiv1.PersistentVolumeClaimVolumeSource{
+					ClaimName: source.Pvc, ReadOnly: true,
+				}
+			} else {
+				volume.VolumeSource = *source.Volume
+			}
+			spec.Volumes = append(spec.Volumes, volume)
+			container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+				Name: volume.Name, MountPath: target, SubPath: source.Sub_path, ReadOnly: true,
+			})
+			continue
+		}
+
+		env := []apiv1.EnvVar{
+			{Name: "ARTIFACT_URI", Value: source.Uri},
+			{Name: "ARTIFACT_DIR", Value: target},
+			{Name: "ARTIFACT_SHA256", Value: source.Sha256},
+			{Name: "HOME", Value: "/tmp"},
+		}
+		if source.Endpoint_url != "" {
+			env = append(env, apiv1.EnvVar{Name: "AWS_ENDPOINT_URL", Value: source.Endpoint_url})
+		}
+
+		// Each download is mounted on its own from its directory of the
+		// download volume, next to the PVC and volume sources.
+		container.VolumeMounts = append(container.VolumeMounts, apiv1.VolumeMount{
+			Name: artifactVolume, MountPath: target, SubPath: source.Name, ReadOnly: true,
+		})
+
+		init := apiv1.Container{
+			Name:    "fetch-" + source.Name,
+			Image:   artifacts.image,
+			Command: []string{"/bin/sh", "-c", downloadScript},
+			Env:     env,
+			VolumeMounts: []apiv1.VolumeMount{
+				{Name: artifactVolume, MountPath: mountPath},
+			},
+		}
+		if source.Credentials_secret != "" {
+			init.EnvFrom = []apiv1.EnvFromSource{
+				{SecretRef: &apiv1.SecretEnvSource{
+					LocalObjectReference: apiv1.LocalObjectReference{Name: source.Credentials_secret},
+				}},
+			}
+		}
+		spec.InitContainers = append(spec.InitContainers, init)
+	}
+}
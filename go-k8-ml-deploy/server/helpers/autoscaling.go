@@ -0,0 +1,293 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultMinReplicas    = int32(1)
+	defaultMaxReplicas    = int32(10)
+	defaultCpuUtilization = int32(50)
+
+	// The bounds a weighted canary HPA would have at full traffic, which it
+	// gets back when the canary is promoted.
+	minReplicasAnnotation = "mlops.iolap.com/min-replicas"
+	maxReplicasAnnotation = "mlops.iolap.com/max-replicas"
+)
+
+// Autoscaling sets the HPA of a model. Cpu_utilization and
+// Memory_utilization are average utilization targets in percent of the
+// requests; Metrics adds Pods, Object and External metrics and Behavior takes
+// the autoscaling/v2 scale up and scale down rules, such as a scale down
+// stabilization window. Without any target the HPA keeps cpu at 50%.
+//
+// Every version of an endpoint has its own HPA. With Scale_with_weight the
+// bounds of a canary are scaled down to its share of the traffic.
+//
+// Mode keda scales with a KEDA ScaledObject in place of the HPA, see Keda.
+// Disabled removes the autoscaler and runs a fixed number of Replicas
+// instead.
+type Autoscaling struct {
+	Mode               string                                         `json:"mode"`
+	Keda               *Keda                                          `json:"keda"`
+	Disabled           bool                                           `json:"disabled"`
+	Replicas           *int32                                         `json:"replicas"`
+	Min_replicas       *int32                                         `json:"min_replicas"`
+	Max_replicas       *int32                                         `json:"max_replicas"`
+	Cpu_utilization    *int32                                         `json:"cpu_utilization"`
+	Memory_utilization *int32                                         `json:"memory_utilization"`
+	Metrics            []autoscalingv2.MetricSpec                     `json:"metrics"`
+	Behavior           *autoscalingv2.HorizontalPodAutoscalerBehavior `json:"behavior"`
+	Scale_with_weight  bool                                           `json:"scale_with_weight"`
+}
+
+func (model *ModelDeploy) autoscalingDisabled() bool {
+	return model.Autoscaling != nil && model.Autoscaling.Disabled
+}
+
+// ResolveAutoscaling rejects replica bounds and targets the autoscaler would
+// refuse or never satisfy, with the request field names, and fills in the
+// KEDA defaults from the config.
+func (config *ServerConfig) ResolveAutoscaling(model *ModelDeploy) error {
+
+	autoscaling := model.Autoscaling
+	if autoscaling == nil {
+		return nil
+	}
+
+	invalid := make([]*APIError, 0)
+
+	if autoscaling.Disabled {
+		if autoscaling.Replicas != nil && *autoscaling.Replicas < 0 {
+			invalid = append(invalid, fieldError("autoscaling.replicas", "must not be negative"))
+		}
+		if autoscaling.Min_replicas != nil || autoscaling.Max_replicas != nil || autoscaling.Cpu_utilization != nil ||
+			autoscaling.Memory_utilization != nil || len(autoscaling.Metrics) > 0 || autoscaling.Behavior != nil ||
+			autoscaling.Keda != nil {
+			invalid = append(invalid, fieldError("autoscaling.disabled", "replica bounds and targets need the HPA, set replicas instead"))
+		}
+	} else if autoscaling.Replicas != nil {
+		invalid = append(invalid, fieldError("autoscaling.replicas", "is only used when autoscaling is disabled"))
+	}
+
+	if autoscaling.Scale_with_weight && model.Canary {
+		if _, err := model.canaryWeight(); err != nil {
+			invalid = append(invalid, fieldError("canary_weight", err.Error()))
+		}
+	}
+
+	switch autoscaling.Mode {
+	case "", AutoscalerHpa:
+		if autoscaling.Keda != nil {
+			invalid = append(invalid, fieldError("autoscaling.keda", "is only used in keda mode"))
+		}
+	case AutoscalerKeda:
+		if !autoscaling.Disabled {
+			invalid = append(invalid, config.validateKeda(autoscaling)...)
+		}
+	default:
+		invalid = append(invalid, fieldError("autoscaling.mode", fmt.Sprintf(
+			"unknown autoscaler %q, use hpa or keda", autoscaling.Mode,
+		)))
+	}
+
+	// Only KEDA scales a deployment to zero.
+	minReplicas, maxReplicas := autoscaling.bounds()
+	if model.kedaScaling() && minReplicas < 0 {
+		invalid = append(invalid, fieldError("autoscaling.min_replicas", "must not be negative"))
+	} else if !model.kedaScaling() && minReplicas < 1 {
+		invalid = append(invalid, fieldError("autoscaling.min_replicas", "must be at least 1, or 0 in keda mode"))
+	}
+	if maxReplicas < 1 {
+		invalid = append(invalid, fieldError("autoscaling.max_replicas", "must be at least 1"))
+	}
+	if maxReplicas < minReplicas {
+		invalid = append(invalid, fieldError("autoscaling.max_replicas", fmt.Sprintf(
+			"must not be less than min_replicas %d", minReplicas,
+		)))
+	}
+
+	if autoscaling.Cpu_utilization != nil && *autoscaling.Cpu_utilization < 1 {
+		invalid = append(invalid, fieldError("autoscaling.cpu_utilization", "must be a percentage above 0"))
+	}
+	if autoscaling.Memory_utilization != nil && *autoscaling.Memory_utilization < 1 {
+		invalid = append(invalid, fieldError("autoscaling.memory_utilization", "must be a percentage above 0"))
+	}
+
+	for i, metric := range autoscaling.Metrics {
+		field := fmt.Sprintf("autoscaling.metrics[%d]", i)
+		switch metric.Type {
+		case autoscalingv2.PodsMetricSourceType:
+			if metric.Pods == nil {
+				invalid = append(invalid, fieldError(field+".pods", "is required for Pods metrics"))
+			}
+		case autoscalingv2.ObjectMetricSourceType:
+			if metric.Object == nil {
+				invalid = append(invalid, fieldError(field+".object", "is required for Object metrics"))
+			}
+		case autoscalingv2.ExternalMetricSourceType:
+			if metric.External == nil {
+				invalid = append(invalid, fieldError(field+".external", "is required for External metrics"))
+			}
+		case autoscalingv2.ResourceMetricSourceType, autoscalingv2.ContainerResourceMetricSourceType:
+			invalid = append(invalid, fieldError(field+".type", "use cpu_utilization or memory_utilization for resource metrics"))
+		default:
+			invalid = append(invalid, fieldError(field+".type", fmt.Sprintf(
+				"unknown metric type %q, use Pods, Object or External", metric.Type,
+			)))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid autoscaling fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
+
+func (autoscaling *Autoscaling) bounds() (int32, int32) {
+
+	minReplicas, maxReplicas := defaultMinReplicas, defaultMaxReplicas
+	if autoscaling == nil {
+		return minReplicas, maxReplicas
+	}
+
+	if autoscaling.Min_replicas != nil {
+		minReplicas = *autoscaling.Min_replicas
+		if autoscaling.Max_replicas == nil && minReplicas > maxReplicas {
+			maxReplicas = minReplicas
+		}
+	}
+	if autoscaling.Max_replicas != nil {
+		maxReplicas = *autoscaling.Max_replicas
+	}
+
+	return minReplicas, maxReplicas
+}
+
+func utilizationMetric(name apiv1.ResourceName, target int32) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ResourceMetricSourceType,
+		Resource: &autoscalingv2.ResourceMetricSource{
+			Name: name,
+			Target: autoscalingv2.MetricTarget{
+				Type:               autoscalingv2.UtilizationMetricType,
+				AverageUtilization: &target,
+			},
+		},
+	}
+}
+
+func (autoscaling *Autoscaling) metrics() []autoscalingv2.MetricSpec {
+
+	if autoscaling == nil {
+		return []autoscalingv2.MetricSpec{utilizationMetric(apiv1.ResourceCPU, defaultCpuUtilization)}
+	}
+
+	metrics := make([]autoscalingv2.MetricSpec, 0, len(autoscaling.Metrics)+2)
+	if autoscaling.Cpu_utilization != nil {
+		metrics = append(metrics, utilizationMetric(apiv1.ResourceCPU, *autoscaling.Cpu_utilization))
+	}
+	if autoscaling.Memory_utilization != nil {
+		metrics = append(metrics, utilizationMetric(apiv1.ResourceMemory, *autoscaling.Memory_utilization))
+	}
+	metrics = append(metrics, autoscaling.Metrics...)
+
+	if len(metrics) == 0 {
+		metrics = append(metrics, utilizationMetric(apiv1.ResourceCPU, defaultCpuUtilization))
+	}
+
+	return metrics
+}
+
+// replicas is the fixed replica count of the Deployment. It is nil while the
+// HPA scales it, so the apply does not fight the HPA over the field.
+func (model *ModelDeploy) replicas() *int32 {
+
+	if !model.autoscalingDisabled() {
+		return nil
+	}
+	if model.Autoscaling.Replicas != nil {
+		return model.Autoscaling.Replicas
+	}
+
+	replicas := defaultMinReplicas
+
+	return &replicas
+}
+
+// canaryWeight is the share of the traffic the canary ingress sends to the
+// model, in percent.
+func (model *ModelDeploy) canaryWeight() (int32, error) {
+
+	if model.Canary_weight == nil {
+		return 0, fmt.Errorf("is required to scale the canary with its weight")
+	}
+
+	weight, err := strconv.Atoi(*model.Canary_weight)
+	if err != nil || weight < 0 || weight > 100 {
+		return 0, fmt.Errorf("%q is not a percentage between 0 and 100", *model.Canary_weight)
+	}
+
+	return int32(weight), nil
+}
+
+// weighted scales a replica bound to the traffic weight of a canary, rounding
+// up so a canary keeps at least one replica unless it may scale to zero.
+func weighted(replicas, weight int32) int32 {
+
+	scaled := (replicas*weight + 99) / 100
+	if scaled < 1 && replicas > 0 {
+		return 1
+	}
+
+	return scaled
+}
+
+// weightAnnotations record the bounds of a canary scaled with its traffic
+// weight before they are scaled.
+func (model *ModelDeploy) weightAnnotations(minReplicas, maxReplicas int32) map[string]string {
+
+	if !model.Canary || model.Autoscaling == nil || !model.Autoscaling.Scale_with_weight {
+		return nil
+	}
+
+	return map[string]string{
+		minReplicasAnnotation: strconv.Itoa(int(minReplicas)),
+		maxReplicasAnnotation: strconv.Itoa(int(maxReplicas)),
+	}
+}
+
+func (model *ModelDeploy) weightedBounds(minReplicas, maxReplicas int32) (int32, int32) {
+
+	if !model.Canary || model.Autoscaling == nil || !model.Autoscaling.Scale_with_weight {
+		return minReplicas, maxReplicas
+	}
+
+	// Validated by ResolveAutoscaling.
+	weight, _ := model.canaryWeight()
+
+	return weighted(minReplicas, weight), weighted(maxReplicas, weight)
+}
+
+func (model *ModelDeploy) applyAutoscaling(hpa *autoscalingv2.HorizontalPodAutoscaler) {
+
+	minReplicas, maxReplicas := model.Autoscaling.bounds()
+
+	hpa.Annotations = model.weightAnnotations(minReplicas, maxReplicas)
+	minReplicas, maxReplicas = model.weightedBounds(minReplicas, maxReplicas)
+
+	hpa.Spec.MinReplicas = &minReplicas
+	hpa.Spec.MaxReplicas = maxReplicas
+	hpa.Spec.Metrics = model.Autoscaling.metrics()
+	if model.Autoscaling != nil {
+		hpa.Spec.Behavior = model.Autoscaling.Behavior
+	}
+}
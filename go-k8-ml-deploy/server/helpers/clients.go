@@ -0,0 +1,40 @@
+package helpers
+
+import (
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	hpav2 "k8s.io/client-go/kubernetes/typed/autoscaling/v2"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	ingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+)
+
+// Clients groups the namespaced clients used to manage one model endpoint.
+type Clients struct {
+	Namespace   string
+	Deployments v1.DeploymentInterface
+	Services    corev1.ServiceInterface
+	Ingresses   ingv1.IngressInterface
+	Hpas        hpav2.HorizontalPodAutoscalerInterface
+	Pods        corev1.PodInterface
+	Endpoints   corev1.EndpointsInterface
+	Secrets     corev1.SecretInterface
+
+	// ScaledObjects are KEDA objects, which have no typed client.
+	ScaledObjects dynamic.ResourceInterface
+}
+
+func NewClients(clientset kubernetes.Interface, dynamicClient dynamic.Interface, namespace string) *Clients {
+	return &Clients{
+		Namespace:   namespace,
+		Deployments: clientset.AppsV1().Deployments(namespace),
+		Services:    clientset.CoreV1().Services(namespace),
+		Ingresses:   clientset.NetworkingV1().Ingresses(namespace),
+		Hpas:        clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace),
+		Pods:        clientset.CoreV1().Pods(namespace),
+		Endpoints:   clientset.CoreV1().Endpoints(namespace),
+		Secrets:     clientset.CoreV1().Secrets(namespace),
+
+		ScaledObjects: dynamicClient.Resource(scaledObjectResource).Namespace(namespace),
+	}
+}
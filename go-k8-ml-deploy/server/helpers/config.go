@@ -0,0 +1,204 @@
+package helpers
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// anyNamespace keys the per-namespace settings that apply to namespaces
+// without an entry of their own.
+const anyNamespace = "*"
+
+type ServerConfig struct {
+	Namespace          string   `json:"namespace"`
+	Allowed_namespaces []string `json:"allowed_namespaces"`
+	Kubeconfig         string   `json:"kubeconfig"`
+	Context            string   `json:"context"`
+	Qps                float32  `json:"qps"`
+	Burst              int      `json:"burst"`
+	Async_workers      int      `json:"async_workers"`
+	Async_queue_size   int      `json:"async_queue_size"`
+	Operation_timeout  int      `json:"operation_timeout_seconds"`
+
+	// Max_resources and Security_policies are keyed by namespace; "*"
+	// applies to every namespace without an entry of its own.
+	Max_resources     map[string]ResourceMaximums `json:"max_resources"`
+	Security_policies map[string]SecurityPolicy   `json:"security_policies"`
+
+	// Accelerators maps pool names usable in accelerator.pool to the
+	// resource name and scheduling constraints of that pool.
+	Accelerators map[string]AcceleratorPool `json:"accelerators"`
+
+	// Stage_scheduling replaces the built-in scheduling defaults of a model
+	// stage, such as Production or Staging.
+	Stage_scheduling map[string]Scheduling `json:"stage_scheduling"`
+
+	// Artifact_image runs the artifact download init containers. It needs
+	// the aws CLI and sha256sum.
+	Artifact_image string `json:"artifact_image"`
+
+	// Default_image is deployed when a request names no image.
+	// Image_pull_secrets are added to every model, and registries listed in
+	// Insecure_registries are queried over plain HTTP when resolving digests.
+	Default_image       string   `json:"default_image"`
+	Image_pull_secrets  []string `json:"image_pull_secrets"`
+	Insecure_registries []string `json:"insecure_registries"`
+
+	// Prometheus_address is queried by KEDA prometheus triggers that name no
+	// server_address.
+	Prometheus_address string `json:"prometheus_address"`
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// LoadConfig builds the server configuration from, in increasing order of
+// precedence, built-in defaults, the config file, MLOPS_* env vars and flags.
+// An empty namespace is filled in by NewKubeConfig once the cluster
+// connection is known.
+func LoadConfig() (*ServerConfig, error) {
+
+	configPath := flag.String("config", "", "path to a JSON or YAML server config file (env MLOPS_CONFIG)")
+	namespace := flag.String("namespace", "", "default namespace for model endpoints (env MLOPS_NAMESPACE)")
+	allowedNamespaces := flag.String(
+		"allowed-namespaces", "", "comma separated namespaces requests may target (env MLOPS_ALLOWED_NAMESPACES)",
+	)
+	kubeconfig := flag.String("kubeconfig", "", "kubeconfig used when not running in cluster (env KUBECONFIG)")
+	kubeContext := flag.String("context", "", "kubeconfig context to use")
+	qps := flag.Float64("qps", 0, "Kubernetes client queries per second (env MLOPS_KUBE_QPS)")
+	burst := flag.Int("burst", 0, "Kubernetes client burst (env MLOPS_KUBE_BURST)")
+	asyncWorkers := flag.Int("async-workers", 0, "workers running asynchronous operations (env MLOPS_ASYNC_WORKERS)")
+	defaultImage := flag.String("default-image", "", "image deployed when a request names none (env MLOPS_DEFAULT_IMAGE)")
+	flag.Parse()
+
+	config := &ServerConfig{
+		Async_workers:     4,
+		Async_queue_size:  100,
+		Operation_timeout: 600,
+	}
+
+	path := os.Getenv("MLOPS_CONFIG")
+	if *configPath != "" {
+		path = *configPath
+	}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+	}
+
+	if value := os.Getenv("MLOPS_NAMESPACE"); value != "" {
+		config.Namespace = value
+	}
+	if *namespace != "" {
+		config.Namespace = *namespace
+	}
+
+	if value := os.Getenv("MLOPS_ALLOWED_NAMESPACES"); value != "" {
+		config.Allowed_namespaces = splitList(value)
+	}
+	if *allowedNamespaces != "" {
+		config.Allowed_namespaces = splitList(*allowedNamespaces)
+	}
+
+	if *kubeconfig != "" {
+		config.Kubeconfig = *kubeconfig
+	}
+	if *kubeContext != "" {
+		config.Context = *kubeContext
+	}
+
+	if value := os.Getenv("MLOPS_KUBE_QPS"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MLOPS_KUBE_QPS: %w", err)
+		}
+		config.Qps = float32(parsed)
+	}
+	if *qps != 0 {
+		config.Qps = float32(*qps)
+	}
+
+	if value := os.Getenv("MLOPS_KUBE_BURST"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MLOPS_KUBE_BURST: %w", err)
+		}
+		config.Burst = parsed
+	}
+	if *burst != 0 {
+		config.Burst = *burst
+	}
+
+	if value := os.Getenv("MLOPS_ASYNC_WORKERS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing MLOPS_ASYNC_WORKERS: %w", err)
+		}
+		config.Async_workers = parsed
+	}
+	if *asyncWorkers != 0 {
+		config.Async_workers = *asyncWorkers
+	}
+
+	if value := os.Getenv("MLOPS_DEFAULT_IMAGE"); value != "" {
+		config.Default_image = value
+	}
+	if *defaultImage != "" {
+		config.Default_image = *defaultImage
+	}
+
+	// Without workers queued operations never run, and without a queue every
+	// asynchronous request is rejected.
+	if config.Async_workers < 1 {
+		return nil, fmt.Errorf("async_workers must be at least 1, got %d", config.Async_workers)
+	}
+	if config.Async_queue_size < 1 {
+		return nil, fmt.Errorf("async_queue_size must be at least 1, got %d", config.Async_queue_size)
+	}
+	if config.Operation_timeout < 1 {
+		return nil, fmt.Errorf("operation_timeout_seconds must be at least 1, got %d", config.Operation_timeout)
+	}
+
+	if err := config.validateSecurityPolicies(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ResolveNamespace returns the namespace a request should act on. An empty
+// request namespace means the configured default, which is always allowed.
+func (config *ServerConfig) ResolveNamespace(namespace string) (string, error) {
+
+	if namespace == "" || namespace == config.Namespace {
+		return config.Namespace, nil
+	}
+
+	for _, allowed := range config.Allowed_namespaces {
+		if allowed == namespace {
+			return namespace, nil
+		}
+	}
+
+	return "", fmt.Errorf("namespace %q is not allowed", namespace)
+}
@@ -0,0 +1,144 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values one field of a cron expression matches.
+type cronField struct {
+	values uint64
+	any    bool
+}
+
+func (field cronField) has(value int) bool {
+	return field.values&(1<<uint(value)) != 0
+}
+
+// cronExpression is a standard five field cron expression: minute, hour, day
+// of month, month and day of week.
+type cronExpression struct {
+	minute, hour, dayOfMonth, month, dayOfWeek cronField
+}
+
+type cronRange struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var cronRanges = []cronRange{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is Sunday as well as 0.
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+func (bounds cronRange) value(text string) (int, error) {
+
+	for i, name := range bounds.names {
+		if strings.EqualFold(text, name) {
+			return bounds.min + i, nil
+		}
+	}
+
+	value, err := strconv.Atoi(text)
+	if err != nil || value < bounds.min || value > bounds.max {
+		return 0, fmt.Errorf("%s %q is not between %d and %d", bounds.name, text, bounds.min, bounds.max)
+	}
+
+	return value, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges such as
+// 1-5 or mon-fri, and steps such as */15 or 8-18/2.
+func parseCronField(text string, bounds cronRange) (cronField, error) {
+
+	field := cronField{any: strings.HasPrefix(text, "*")}
+
+	for _, part := range strings.Split(text, ",") {
+		span, stepText, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepText)
+			if err != nil || parsed < 1 {
+				return field, fmt.Errorf("%s step %q is not a positive number", bounds.name, stepText)
+			}
+			step = parsed
+		}
+
+		low, high := bounds.min, bounds.max
+		if span != "*" {
+			lowText, highText, isRange := strings.Cut(span, "-")
+			value, err := bounds.value(lowText)
+			if err != nil {
+				return field, err
+			}
+			low, high = value, value
+			if isRange {
+				if high, err = bounds.value(highText); err != nil {
+					return field, err
+				}
+			} else if hasStep {
+				high = bounds.max
+			}
+		}
+		if low > high {
+			return field, fmt.Errorf("%s range %q is reversed", bounds.name, span)
+		}
+
+		for value := low; value <= high; value += step {
+			field.values |= 1 << uint(value)
+		}
+	}
+
+	return field, nil
+}
+
+func parseCron(expression string) (*cronExpression, error) {
+
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronRanges) {
+		return nil, fmt.Errorf("%q has %d fields, cron expressions have 5", expression, len(fields))
+	}
+
+	parsed := make([]cronField, len(fields))
+	for i, text := range fields {
+		field, err := parseCronField(text, cronRanges[i])
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = field
+	}
+
+	// Sunday is matched as 0.
+	if parsed[4].has(7) {
+		parsed[4].values |= 1
+	}
+
+	return &cronExpression{parsed[0], parsed[1], parsed[2], parsed[3], parsed[4]}, nil
+}
+
+// matches reports whether the minute of t is one of the expression. As in
+// cron, a day matches either the day of month or the day of week when both
+// are restricted.
+func (cron *cronExpression) matches(t time.Time) bool {
+
+	if !cron.minute.has(t.Minute()) || !cron.hour.has(t.Hour()) || !cron.month.has(int(t.Month())) {
+		return false
+	}
+
+	dayOfMonth := cron.dayOfMonth.has(t.Day())
+	dayOfWeek := cron.dayOfWeek.has(int(t.Weekday()))
+
+	if cron.dayOfMonth.any || cron.dayOfWeek.any {
+		return dayOfMonth && dayOfWeek
+	}
+
+	return dayOfMonth || dayOfWeek
+}
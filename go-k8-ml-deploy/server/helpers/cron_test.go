@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"* * * * *", true},
+		{"*/15 8-18/2 1,15 jan-jun mon-fri", true},
+		{"0 0 * * 7", true},
+		{"0 0 * * SUN", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"* * * * sunday", false},
+		{"* 18-8 * * *", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"1,,2 * * * *", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := parseCron(test.expression)
+			if (err == nil) != test.valid {
+				t.Errorf("parseCron(%q) error = %v, want valid %v", test.expression, err, test.valid)
+			}
+		})
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+
+	// 2026-06-01 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.June, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		time       time.Time
+		matches    bool
+	}{
+		{"every minute", "* * * * *", at(3, 4, 5), true},
+		{"working hours weekday", "* 8-17 * * mon-fri", at(1, 9, 0), true},
+		{"working hours saturday", "* 8-17 * * mon-fri", at(6, 9, 0), false},
+		{"working hours evening", "* 8-17 * * mon-fri", at(1, 18, 0), false},
+		{"quarter hour", "*/15 * * * *", at(2, 10, 45), true},
+		{"off quarter hour", "*/15 * * * *", at(2, 10, 46), false},
+		{"stepped range", "0 8-18/2 * * *", at(2, 10, 0), true},
+		{"off stepped range", "0 8-18/2 * * *", at(2, 11, 0), false},
+		{"stepped value", "5/20 * * * *", at(2, 10, 45), true},
+		{"list", "0 9,17 * * *", at(2, 17, 0), true},
+		{"sunday as 7", "0 0 * * 7", at(7, 0, 0), true},
+		{"sunday as 0", "0 0 * * 0", at(7, 0, 0), true},
+		{"month name", "0 0 * jun *", at(2, 0, 0), true},
+		{"other month", "0 0 * jul *", at(2, 0, 0), false},
+		{"day of month or week, month", "0 0 1 * fri", at(1, 0, 0), true},
+		{"day of month or week, week", "0 0 1 * fri", at(5, 0, 0), true},
+		{"day of month or week, neither", "0 0 1 * fri", at(2, 0, 0), false},
+		{"starred day of week", "0 0 1 * */2", at(2, 0, 0), false},
+		{"starred day of month", "0 0 */2 * mon", at(1, 0, 0), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cron, err := parseCron(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if matches := cron.matches(test.time); matches != test.matches {
+				t.Errorf("%q matches %s = %v, want %v", test.expression, test.time, matches, test.matches)
+			}
+		})
+	}
+}
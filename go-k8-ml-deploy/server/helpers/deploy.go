@@ -0,0 +1,187 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	StepPending    = "Pending"
+	StepRunning    = "Running"
+	StepSucceeded  = "Succeeded"
+	StepFailed     = "Failed"
+	StepSkipped    = "Skipped"
+	StepRolledBack = "RolledBack"
+)
+
+// ProgressFunc is told about every state change of a resource while a
+// request is applied. A nil ProgressFunc ignores updates.
+type ProgressFunc func(kind, name, state string, err error)
+
+func (progress ProgressFunc) report(kind, name, state string, err error) {
+	if progress != nil {
+		progress(kind, name, state, err)
+	}
+}
+
+type deployStep struct {
+	kind string
+	name string
+	run  func(ctx context.Context) error
+}
+
+type stepResult struct {
+	kind string
+	name string
+	err  error
+}
+
+func runDeployStep(ctx context.Context, step deployStep, progress ProgressFunc, results chan stepResult) {
+
+	progress.report(step.kind, step.name, StepRunning, nil)
+
+	err := step.run(ctx)
+	if err != nil {
+		progress.report(step.kind, step.name, StepFailed, err)
+	} else {
+		progress.report(step.kind, step.name, StepSucceeded, nil)
+	}
+
+	results <- stepResult{step.kind, step.name, err}
+}
+
+func collectFailures(results chan stepResult) []StepError {
+
+	failed := make([]StepError, 0)
+	for i := 0; i < cap(results); i++ {
+		result := <-results
+		if result.err != nil {
+			classified := ClassifyError(result.err)
+			failure := StepError{
+				Kind:   result.kind,
+				Name:   result.name,
+				Code:   classified.Code,
+				Reason: classified.Reason,
+				Error:  result.err.Error(),
+			}
+			var conflict *ApplyConflict
+			if errors.As(result.err, &conflict) {
+				failure.Conflicts = conflict.Conflicts
+			}
+			failed = append(failed, failure)
+		}
+	}
+
+	return failed
+}
+
+// RunDeploy creates or updates the Deployment, Service and Ingress of an
+// endpoint in parallel and then its autoscaler. If any step fails, every object it
+// created is deleted and every object it updated is put back, and the
+// returned *DeployFailure says what failed and what was rolled back.
+func RunDeploy(
+	ctx context.Context,
+	clients *Clients,
+	model *ModelDeploy,
+	model_names, endpoint string,
+	progress ProgressFunc,
+) error {
+
+	name := endpoint + model.canaryVersion()
+	var tx *DeployTransaction
+	if !model.Dry_run {
+		tx = new(DeployTransaction)
+	}
+
+	steps := []deployStep{
+		{"Deployment", name, func(ctx context.Context) error {
+			return CrudDeployment(ctx, clients.Deployments, model, model_names, endpoint, tx)
+		}},
+		{"Service", name, func(ctx context.Context) error {
+			return CrudService(ctx, clients.Services, model, endpoint, tx)
+		}},
+		{"Ingress", name, func(ctx context.Context) error {
+			return CrudIngress(ctx, clients.Ingresses, model, endpoint, tx)
+		}},
+	}
+	hpaStep := deployStep{model.autoscalerKind(), name, func(ctx context.Context) error {
+		return CrudAutoscaler(ctx, clients, model, endpoint, tx)
+	}}
+
+	results := make(chan stepResult, len(steps))
+
+	for _, step := range steps {
+		go runDeployStep(ctx, step, progress, results)
+	}
+
+	failed := collectFailures(results)
+
+	if len(failed) == 0 {
+		hpaResults := make(chan stepResult, 1)
+		runDeployStep(ctx, hpaStep, progress, hpaResults)
+		failed = collectFailures(hpaResults)
+	} else {
+		progress.report(hpaStep.kind, hpaStep.name, StepSkipped, nil)
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	failure := &DeployFailure{Endpoint: name, Failed: failed}
+	failure.Rolled_back, failure.Complete = tx.Rollback(progress)
+
+	return failure
+}
+
+// DeployEndpoint runs RunDeploy and, when the request sets wait, blocks until
+// the new version is serving. A rollout that does not finish in time returns
+// a *RolloutFailure.
+func DeployEndpoint(
+	ctx context.Context,
+	clients *Clients,
+	model *ModelDeploy,
+	model_names, endpoint string,
+	progress ProgressFunc,
+) (*DeployReturn, error) {
+
+	if err := RunDeploy(ctx, clients, model, model_names, endpoint, progress); err != nil {
+		return nil, err
+	}
+
+	message := NewDeployReturn(model, endpoint)
+
+	if model.Wait {
+		name := endpoint + model.canaryVersion()
+		progress.report("Rollout", name, StepRunning, nil)
+
+		status, err := WaitForRollout(
+			ctx, clients, endpoint, model.canaryVersion(), name, model.rolloutTimeout(),
+		)
+		if err != nil {
+			progress.report("Rollout", name, StepFailed, err)
+			return nil, err
+		}
+
+		progress.report("Rollout", name, StepSucceeded, nil)
+		message.Rollout = status
+	}
+
+	return message, nil
+}
+
+// DeploySteps lists the resources DeployEndpoint will touch, in order, so callers
+// can report them before work starts.
+func DeploySteps(model *ModelDeploy, endpoint string) []ResourceProgress {
+	name := endpoint + model.canaryVersion()
+	steps := []ResourceProgress{
+		{Kind: "Deployment", Name: name, State: StepPending},
+		{Kind: "Service", Name: name, State: StepPending},
+		{Kind: "Ingress", Name: name, State: StepPending},
+		{Kind: model.autoscalerKind(), Name: name, State: StepPending},
+	}
+	if model.Wait {
+		steps = append(steps, ResourceProgress{Kind: "Rollout", Name: name, State: StepPending})
+	}
+	return steps
+}
@@ -0,0 +1,398 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ActionCreate = "Create"
+	ActionUpdate = "Update"
+	ActionDelete = "Delete"
+	ActionNone   = "None"
+)
+
+type PlannedChange struct {
+	Kind   string
+	Name   string
+	Action string
+	Valid  bool
+	Error  string
+	Object interface{} `json:",omitempty"`
+}
+
+type DryRunReturn struct {
+	Dry_run   bool
+	Endpoint  string
+	Namespace string
+	Valid     bool
+	Changes   []PlannedChange
+}
+
+// CheckOutputFormat accepts the formats a dry run can be rendered in.
+func CheckOutputFormat(output string) error {
+	if output != "" && output != "json" && output != "yaml" {
+		return fmt.Errorf("unknown output format %q, use json or yaml", output)
+	}
+	return nil
+}
+
+func plannedAction(err error, exists, missing string) (string, error) {
+	if err == nil {
+		return exists, nil
+	}
+	if apierrors.IsNotFound(err) {
+		return missing, nil
+	}
+	return "", err
+}
+
+func (message *DryRunReturn) add(change PlannedChange) {
+	message.Changes = append(message.Changes, change)
+	if !change.Valid {
+		message.Valid = false
+	}
+}
+
+// DryRunDeploy renders the objects a deploy would apply and sends them
+// through the regular deploy path with DryRun: All, so the API server
+// validates them without persisting anything.
+func DryRunDeploy(
+	ctx context.Context,
+	clients *Clients,
+	model *ModelDeploy,
+	model_names, endpoint string,
+) (*DryRunReturn, error) {
+
+	// The caller's model is left as it was.
+	dryRunModel := *model
+	model = &dryRunModel
+	model.Dry_run = true
+
+	deployment := newDeployment(model, model_names, endpoint)
+	service := newService(model, endpoint)
+	ingress := newIngress(model, endpoint)
+	hpa := newHpa(model, endpoint)
+
+	_, deploymentErr := clients.Deployments.Get(ctx, deployment.Name, metav1.GetOptions{})
+	_, serviceErr := clients.Services.Get(ctx, service.Name, metav1.GetOptions{})
+	_, ingressErr := clients.Ingresses.Get(ctx, ingress.Name, metav1.GetOptions{})
+	existingHpa, hpaErr := clients.Hpas.Get(ctx, hpa.Name, metav1.GetOptions{})
+
+	changes := []PlannedChange{
+		{Kind: "Deployment", Name: deployment.Name, Object: deployment},
+		{Kind: "Service", Name: service.Name, Object: service},
+		{Kind: "Ingress", Name: ingress.Name, Object: ingress},
+		{Kind: "HorizontalPodAutoscaler", Name: hpa.Name, Object: hpa},
+	}
+
+	for i, getErr := range []error{deploymentErr, serviceErr, ingressErr, hpaErr} {
+		action, err := plannedAction(getErr, ActionUpdate, ActionCreate)
+		if err != nil {
+			return nil, err
+		}
+		changes[i].Action = action
+	}
+
+	// Without an HPA of its own the HPA of the deployment is deleted, and one
+	// scaling another deployment is left alone.
+	if !model.usesHpa() {
+		hpaChange := &changes[len(changes)-1]
+		hpaChange.Object = nil
+		hpaChange.Action = ActionNone
+		if hpaErr == nil && existingHpa.Spec.ScaleTargetRef.Name == deployment.Name {
+			hpaChange.Action = ActionDelete
+		}
+	}
+
+	existingScaledObject, scaledObjectErr := clients.ScaledObjects.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if model.kedaScaling() {
+		scaledObject := newScaledObject(model, endpoint)
+		action, err := plannedAction(scaledObjectErr, ActionUpdate, ActionCreate)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, PlannedChange{
+			Kind: "ScaledObject", Name: scaledObject.GetName(), Action: action, Object: scaledObject,
+		})
+	} else if scaledObjectErr == nil && scaledObjectTarget(existingScaledObject) == deployment.Name {
+		changes = append(changes, PlannedChange{Kind: "ScaledObject", Name: deployment.Name, Action: ActionDelete})
+	}
+
+	validation := make(map[string]string)
+	collect := func(kind, name, state string, err error) {
+		switch {
+		case err != nil:
+			validation[kind] = err.Error()
+		case state == StepSkipped:
+			validation[kind] = "not validated because an earlier step failed"
+		}
+	}
+
+	deployErr := RunDeploy(ctx, clients, model, model_names, endpoint, collect)
+
+	var failure *DeployFailure
+	if deployErr != nil && !errors.As(deployErr, &failure) {
+		return nil, deployErr
+	}
+
+	message := &DryRunReturn{
+		Dry_run:   true,
+		Endpoint:  endpoint,
+		Namespace: model.Namespace,
+		Valid:     true,
+		Changes:   make([]PlannedChange, 0, len(changes)),
+	}
+
+	listed := make(map[string]bool)
+	for _, change := range changes {
+		change.Error = validation[change.Kind]
+		change.Valid = change.Error == ""
+		message.add(change)
+		listed[change.Kind] = true
+	}
+
+	// Steps without a planned change still fail the dry run.
+	unlisted := make([]string, 0)
+	for kind := range validation {
+		if !listed[kind] {
+			unlisted = append(unlisted, kind)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, kind := range unlisted {
+		message.add(PlannedChange{Kind: kind, Action: ActionNone, Valid: false, Error: validation[kind]})
+	}
+
+	return message, nil
+}
+
+// planDelete checks whether an object exists and, if so, validates deleting
+// it with a server-side dry run.
+func planDelete(
+	ctx context.Context,
+	kind, name string,
+	get func(ctx context.Context, name string, options metav1.GetOptions) error,
+	remove func(ctx context.Context, name string, options metav1.DeleteOptions) error,
+) (PlannedChange, error) {
+
+	change := PlannedChange{Kind: kind, Name: name, Valid: true}
+
+	action, err := plannedAction(get(ctx, name, metav1.GetOptions{}), ActionDelete, ActionNone)
+	if err != nil {
+		return change, err
+	}
+	change.Action = action
+
+	if action == ActionDelete {
+		if err := remove(ctx, name, metav1.DeleteOptions{DryRun: []string{metav1.DryRunAll}}); err != nil {
+			change.Valid = false
+			change.Error = err.Error()
+		}
+	} else {
+		change.Error = "not found"
+	}
+
+	return change, nil
+}
+
+func planDeletes(
+	ctx context.Context,
+	clients *Clients,
+	message *DryRunReturn,
+	deploymentName, serviceName, ingressName, hpaName string,
+) error {
+
+	plans := []struct {
+		kind   string
+		name   string
+		get    func(ctx context.Context, name string, options metav1.GetOptions) error
+		remove func(ctx context.Context, name string, options metav1.DeleteOptions) error
+	}{
+		{"Deployment", deploymentName, func(ctx context.Context, name string, options metav1.GetOptions) error {
+			_, err := clients.Deployments.Get(ctx, name, options)
+			return err
+		}, clients.Deployments.Delete},
+		{"Service", serviceName, func(ctx context.Context, name string, options metav1.GetOptions) error {
+			_, err := clients.Services.Get(ctx, name, options)
+			return err
+		}, clients.Services.Delete},
+		{"Ingress", ingressName, func(ctx context.Context, name string, options metav1.GetOptions) error {
+			_, err := clients.Ingresses.Get(ctx, name, options)
+			return err
+		}, clients.Ingresses.Delete},
+		{"HorizontalPodAutoscaler", hpaName, func(ctx context.Context, name string, options metav1.GetOptions) error {
+			_, err := clients.Hpas.Get(ctx, name, options)
+			return err
+		}, clients.Hpas.Delete},
+	}
+
+	// ScaledObjects share the name of the HPA; clusters without KEDA have
+	// none to delete.
+	scaledObject, err := planDelete(ctx, "ScaledObject", hpaName,
+		func(ctx context.Context, name string, options metav1.GetOptions) error {
+			_, err := clients.ScaledObjects.Get(ctx, name, options)
+			return err
+		},
+		func(ctx context.Context, name string, options metav1.DeleteOptions) error {
+			return clients.ScaledObjects.Delete(ctx, name, options)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, plan := range plans {
+		change, err := planDelete(ctx, plan.kind, plan.name, plan.get, plan.remove)
+		if err != nil {
+			return err
+		}
+		message.add(change)
+	}
+
+	if scaledObject.Action == ActionDelete {
+		message.add(scaledObject)
+	}
+
+	return nil
+}
+
+// DryRunDestroy lists the objects /destroy would delete.
+func DryRunDestroy(ctx context.Context, clients *Clients, model *ModelDestroy) (*DryRunReturn, error) {
+
+	message := &DryRunReturn{
+		Dry_run:   true,
+		Endpoint:  model.Endpoint,
+		Namespace: model.Namespace,
+		Valid:     true,
+		Changes:   make([]PlannedChange, 0),
+	}
+
+	err := planDeletes(ctx, clients, message, model.Endpoint, model.Endpoint, model.Endpoint, model.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// DryRunTransition shows the stable Service as /transition would leave it and
+// lists the objects it would delete.
+func DryRunTransition(
+	ctx context.Context, clients *Clients, model *ModelTransition, toDestroy string,
+) (*DryRunReturn, error) {
+
+	message := &DryRunReturn{
+		Dry_run:   true,
+		Endpoint:  model.Endpoint,
+		Namespace: model.Namespace,
+		Valid:     true,
+		Changes:   make([]PlannedChange, 0),
+	}
+
+	change := PlannedChange{Kind: "Service", Name: model.Endpoint, Action: ActionUpdate, Valid: true}
+
+	service, err := clients.Services.Get(ctx, model.Endpoint, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if err != nil {
+		change.Action = ActionNone
+		change.Valid = false
+		change.Error = err.Error()
+	} else {
+		config, applyErr := transitionServiceApply(service, model)
+		if applyErr == nil {
+			change.Object, applyErr = clients.Services.Apply(ctx, config, metav1.ApplyOptions{
+				FieldManager: FieldManager, Force: true, DryRun: []string{metav1.DryRunAll},
+			})
+		}
+		if applyErr != nil {
+			change.Valid = false
+			change.Error = applyErr.Error()
+			change.Object = config
+		}
+	}
+	message.add(change)
+
+	// A canary HPA scaled with its traffic weight gets its full bounds back.
+	hpa, err := clients.Hpas.Get(ctx, toDestroy, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		config, applyErr := transitionHpaApply(hpa)
+		if config != nil || applyErr != nil {
+			hpaChange := PlannedChange{Kind: "HorizontalPodAutoscaler", Name: toDestroy, Action: ActionUpdate, Valid: true}
+			if applyErr == nil {
+				hpaChange.Object, applyErr = clients.Hpas.Apply(ctx, config, metav1.ApplyOptions{
+					FieldManager: FieldManager, Force: true, DryRun: []string{metav1.DryRunAll},
+				})
+			}
+			if applyErr != nil {
+				hpaChange.Valid = false
+				hpaChange.Error = applyErr.Error()
+				if config != nil {
+					hpaChange.Object = config
+				}
+			}
+			message.add(hpaChange)
+		}
+	}
+
+	scaledObject, err := clients.ScaledObjects.Get(ctx, toDestroy, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		applied, applyErr := transitionScaledObjectApply(scaledObject, model.Endpoint, toDestroy)
+		if applied != nil || applyErr != nil {
+			scaledChange := PlannedChange{Kind: "ScaledObject", Name: toDestroy, Action: ActionUpdate, Valid: true}
+			if applyErr == nil {
+				force := true
+				data, _ := applied.MarshalJSON()
+				scaledChange.Object, applyErr = clients.ScaledObjects.Patch(ctx, toDestroy, types.ApplyPatchType, data,
+					metav1.PatchOptions{FieldManager: FieldManager, Force: &force, DryRun: []string{metav1.DryRunAll}},
+				)
+			}
+			if applyErr != nil {
+				scaledChange.Valid = false
+				scaledChange.Error = applyErr.Error()
+				if applied != nil {
+					scaledChange.Object = applied
+				}
+			}
+			message.add(scaledChange)
+		}
+	}
+
+	err = planDeletes(ctx, clients, message, model.Endpoint, toDestroy, toDestroy, model.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// CreateDryRunResponse renders a dry run as JSON, or as YAML when asked to,
+// and returns the matching content type.
+func CreateDryRunResponse(message *DryRunReturn, output string) ([]byte, string, error) {
+
+	if output == "yaml" {
+		message_parsed, error := yaml.Marshal(message)
+		return message_parsed, "application/yaml", error
+	}
+
+	message_parsed, error := json.Marshal(message)
+
+	return message_parsed, "application/json", error
+}
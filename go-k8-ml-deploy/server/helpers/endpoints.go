@@ -0,0 +1,334 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+const (
+	defaultEndpointsLimit = 50
+	maxEndpointsLimit     = 500
+)
+
+type EndpointFilter struct {
+	Model_name  string `query:"model_name"`
+	Model_stage string `query:"stage"`
+	Canary      string `query:"canary"`
+	Namespace   string `query:"namespace"`
+	Offset      int    `query:"offset"`
+	Limit       int    `query:"limit"`
+}
+
+type EndpointVersion struct {
+	Name             string
+	Canary           bool
+	Canary_version   string
+	Canary_weight    string
+	Model_names      []string
+	Image            string
+	Model_stage      string
+	Resources        apiv1.ResourceRequirements
+	Replicas         int32
+	Service          string
+	Ingress          string
+	Hpa              string
+	Hpa_min_replicas int32
+	Hpa_max_replicas int32
+}
+
+type EndpointInfo struct {
+	Endpoint  string
+	Namespace string
+	Path      string
+	Versions  []EndpointVersion
+}
+
+type EndpointList struct {
+	Total     int
+	Offset    int
+	Limit     int
+	Endpoints []EndpointInfo
+}
+
+func (filter *EndpointFilter) ParseFilterParams() error {
+
+	if filter.Canary != "" {
+		if _, err := strconv.ParseBool(filter.Canary); err != nil {
+			return err
+		}
+	}
+
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = defaultEndpointsLimit
+	} else if filter.Limit > maxEndpointsLimit {
+		filter.Limit = maxEndpointsLimit
+	}
+
+	return nil
+}
+
+func (filter *EndpointFilter) matches(info *EndpointInfo) bool {
+
+	modelMatch := filter.Model_name == ""
+	stageMatch := filter.Model_stage == ""
+	hasCanary := false
+
+	for _, version := range info.Versions {
+		for _, name := range version.Model_names {
+			if name == filter.Model_name {
+				modelMatch = true
+			}
+		}
+		if strings.EqualFold(version.Model_stage, filter.Model_stage) {
+			stageMatch = true
+		}
+		if version.Canary {
+			hasCanary = true
+		}
+	}
+
+	if filter.Canary != "" {
+		wantCanary, _ := strconv.ParseBool(filter.Canary)
+		if wantCanary != hasCanary {
+			return false
+		}
+	}
+
+	return modelMatch && stageMatch
+}
+
+func containerEnv(container apiv1.Container, name string) string {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return env.Value
+		}
+	}
+	return ""
+}
+
+// endpointVersion splits a deployment name into its endpoint and canary version.
+// Objects created before the endpoint labels existed fall back to the ENDPOINT
+// env var set in newDeployment.
+func endpointVersion(deployment *appsv1.Deployment) (string, string) {
+
+	if endpoint, ok := deployment.Labels[endpointLabel]; ok {
+		return endpoint, deployment.Labels[versionLabel]
+	}
+
+	endpoint := deployment.Name
+	if len(deployment.Spec.Template.Spec.Containers) > 0 {
+		if value := containerEnv(deployment.Spec.Template.Spec.Containers[0], "ENDPOINT"); value != "" {
+			endpoint = value
+		}
+	}
+
+	return endpoint, strings.TrimPrefix(deployment.Name, endpoint)
+}
+
+// managedDeployment reports whether a deployment was created by this server.
+// Objects created before the managed-by label existed are recognised by the
+// app label and ENDPOINT env var newDeployment has always set.
+func managedDeployment(deployment *appsv1.Deployment) bool {
+
+	if deployment.Labels[managedByLabel] == managedByValue {
+		return true
+	}
+	if deployment.Labels["app"] != deployment.Name || len(deployment.Spec.Template.Spec.Containers) == 0 {
+		return false
+	}
+
+	endpoint := containerEnv(deployment.Spec.Template.Spec.Containers[0], "ENDPOINT")
+
+	return endpoint != "" && strings.HasPrefix(deployment.Name, endpoint)
+}
+
+// selects reports whether a Service routes to the pods of a deployment.
+func selects(service *apiv1.Service, deployment *appsv1.Deployment) bool {
+	return len(service.Spec.Selector) > 0 &&
+		labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(deployment.Spec.Template.Labels))
+}
+
+// selectingService returns the Service of a deployment, preferring the one
+// named after it.
+func selectingService(services []apiv1.Service, deployment *appsv1.Deployment) string {
+
+	found := ""
+	for i := range services {
+		if !selects(&services[i], deployment) {
+			continue
+		}
+		if services[i].Name == deployment.Name {
+			return services[i].Name
+		}
+		if found == "" {
+			found = services[i].Name
+		}
+	}
+
+	return found
+}
+
+// routingIngress returns the Ingress with a backend on the named Service.
+func routingIngress(ingresses []networkingv1.Ingress, service string) *networkingv1.Ingress {
+
+	if service == "" {
+		return nil
+	}
+
+	for i := range ingresses {
+		for _, rule := range ingresses[i].Spec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for _, path := range rule.HTTP.Paths {
+				if path.Backend.Service != nil && path.Backend.Service.Name == service {
+					return &ingresses[i]
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ListEndpoints lists every object of the namespace rather than selecting on
+// the managed-by label, which older endpoints do not have, and joins them to
+// the deployments of this server by name.
+func ListEndpoints(ctx context.Context, clients *Clients, filter *EndpointFilter) (*EndpointList, error) {
+
+	listOptions := metav1.ListOptions{}
+
+	deployments, err := clients.Deployments.List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := clients.Services.List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ingresses, err := clients.Ingresses.List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	hpas, err := clients.Hpas.List(ctx, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make(map[string]*EndpointInfo)
+
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if !managedDeployment(deployment) {
+			continue
+		}
+		endpoint, canary_version := endpointVersion(deployment)
+
+		version := EndpointVersion{
+			Name:           deployment.Name,
+			Canary_version: canary_version,
+		}
+
+		if deployment.Spec.Replicas != nil {
+			version.Replicas = *deployment.Spec.Replicas
+		}
+
+		if len(deployment.Spec.Template.Spec.Containers) > 0 {
+			container := deployment.Spec.Template.Spec.Containers[0]
+			version.Image = container.Image
+			version.Model_stage = containerEnv(container, "MODEL_STAGE")
+			version.Resources = container.Resources
+			if names := containerEnv(container, "MODEL_NAMES"); names != "" {
+				version.Model_names = strings.Split(names, ",")
+			}
+		}
+
+		// A promoted version is routed to by the stable Service and Ingress
+		// of the endpoint, so both are joined by what they route to.
+		version.Service = selectingService(services.Items, deployment)
+
+		if ingress := routingIngress(ingresses.Items, version.Service); ingress != nil {
+			version.Ingress = ingress.Name
+			if ingress.Annotations["nginx.ingress.kubernetes.io/canary"] == "true" {
+				version.Canary = true
+				version.Canary_weight = ingress.Annotations["nginx.ingress.kubernetes.io/canary-weight"]
+			}
+		}
+
+		for _, hpa := range hpas.Items {
+			if hpa.Spec.ScaleTargetRef.Name == deployment.Name {
+				version.Hpa = hpa.Name
+				version.Hpa_max_replicas = hpa.Spec.MaxReplicas
+				if hpa.Spec.MinReplicas != nil {
+					version.Hpa_min_replicas = *hpa.Spec.MinReplicas
+				}
+			}
+		}
+
+		info, ok := endpoints[endpoint]
+		if !ok {
+			info = &EndpointInfo{
+				Endpoint:  endpoint,
+				Namespace: clients.Namespace,
+				Path:      "/invocations/" + endpoint,
+			}
+			endpoints[endpoint] = info
+		}
+		info.Versions = append(info.Versions, version)
+	}
+
+	filtered := make([]EndpointInfo, 0, len(endpoints))
+	for _, info := range endpoints {
+		sort.Slice(info.Versions, func(a, b int) bool {
+			return info.Versions[a].Canary_version < info.Versions[b].Canary_version
+		})
+		if filter.matches(info) {
+			filtered = append(filtered, *info)
+		}
+	}
+
+	sort.Slice(filtered, func(a, b int) bool {
+		return filtered[a].Endpoint < filtered[b].Endpoint
+	})
+
+	list := &EndpointList{
+		Total:     len(filtered),
+		Offset:    filter.Offset,
+		Limit:     filter.Limit,
+		Endpoints: []EndpointInfo{},
+	}
+
+	if filter.Offset < len(filtered) {
+		end := filter.Offset + filter.Limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		list.Endpoints = filtered[filter.Offset:end]
+	}
+
+	return list, nil
+}
+
+func CreateEndpointsResponse(list *EndpointList) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(list)
+
+	return message_parsed, error
+}
@@ -0,0 +1,167 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// reservedEnv are set by the server on the model container.
+var reservedEnv = map[string]bool{
+	"MODEL_NAMES":    true,
+	"ENDPOINT":       true,
+	"MODEL_STAGE":    true,
+	"ARTIFACTS_PATH": true,
+}
+
+// credentialWords mark variable names that hold credentials when they appear
+// as whole underscore separated words, as in HF_TOKEN but not in
+// TOKENIZERS_PARALLELISM. Those have to come from a Secret so their values
+// never travel in a request body.
+var credentialWords = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "CREDENTIALS", "API_KEY", "ACCESS_KEY"}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// EnvSource references a Secret or ConfigMap by Name. With Key a single
+// entry is exposed as Env (the key itself when Env is empty); without Key
+// every entry becomes a variable, optionally prefixed with Prefix.
+type EnvSource struct {
+	Name     string `json:"name"`
+	Key      string `json:"key"`
+	Env      string `json:"env"`
+	Prefix   string `json:"prefix"`
+	Optional bool   `json:"optional"`
+}
+
+func (source EnvSource) envName() string {
+	if source.Env != "" {
+		return source.Env
+	}
+	return source.Key
+}
+
+func credentialName(name string) bool {
+	upper := "_" + strings.ToUpper(name) + "_"
+	for _, word := range credentialWords {
+		if strings.Contains(upper, "_"+word+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateEnv rejects variables that would override the reserved ones, names
+// set twice and plain variables that look like credentials.
+func (model *ModelDeploy) ValidateEnv() error {
+
+	invalid := make([]*APIError, 0)
+	names := make(map[string]bool)
+
+	for i, env := range model.Env {
+		field := fmt.Sprintf("env[%d].name", i)
+		switch {
+		case env.Name == "":
+			invalid = append(invalid, fieldError(field, "must not be empty"))
+		case names[env.Name]:
+			invalid = append(invalid, fieldError(field, fmt.Sprintf("%s is set twice", env.Name)))
+		case reservedEnv[env.Name]:
+			invalid = append(invalid, fieldError(field, fmt.Sprintf("%s is set by the server", env.Name)))
+		case credentialName(env.Name):
+			invalid = append(invalid, fieldError(field, fmt.Sprintf(
+				"%s looks like a credential, reference it through env_from_secrets", env.Name,
+			)))
+		}
+		names[env.Name] = true
+	}
+
+	sources := map[string][]EnvSource{
+		"env_from_secrets":    model.Env_from_secrets,
+		"env_from_configmaps": model.Env_from_configmaps,
+	}
+	for _, group := range []string{"env_from_secrets", "env_from_configmaps"} {
+		for i, source := range sources[group] {
+			if source.Name == "" {
+				invalid = append(invalid, fieldError(fmt.Sprintf("%s[%d].name", group, i), "must not be empty"))
+			}
+			if source.Key == "" {
+				if source.Env != "" {
+					invalid = append(invalid, fieldError(fmt.Sprintf("%s[%d].env", group, i), "requires key"))
+				}
+				continue
+			}
+			if reservedEnv[source.envName()] {
+				invalid = append(invalid, fieldError(fmt.Sprintf("%s[%d].env", group, i), fmt.Sprintf(
+					"%s is set by the server", source.envName(),
+				)))
+			} else if names[source.envName()] {
+				invalid = append(invalid, fieldError(fmt.Sprintf("%s[%d].env", group, i), fmt.Sprintf(
+					"%s is set twice", source.envName(),
+				)))
+			}
+			names[source.envName()] = true
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid environment fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
+
+// applyEnv adds the request variables after the reserved ones. Variables set
+// individually take precedence over whole Secrets and ConfigMaps loaded
+// through envFrom, so the reserved names cannot be overridden that way.
+func (model *ModelDeploy) applyEnv(container *apiv1.Container) {
+
+	for _, env := range model.Env {
+		container.Env = append(container.Env, apiv1.EnvVar{Name: env.Name, Value: env.Value})
+	}
+
+	for _, source := range model.Env_from_configmaps {
+		optional := source.Optional
+		reference := apiv1.LocalObjectReference{Name: source.Name}
+		if source.Key == "" {
+			container.EnvFrom = append(container.EnvFrom, apiv1.EnvFromSource{
+				Prefix:       source.Prefix,
+				ConfigMapRef: &apiv1.ConfigMapEnvSource{LocalObjectReference: reference, Optional: &optional},
+			})
+			continue
+		}
+		container.Env = append(container.Env, apiv1.EnvVar{
+			Name: source.envName(),
+			ValueFrom: &apiv1.EnvVarSource{
+				ConfigMapKeyRef: &apiv1.ConfigMapKeySelector{
+					LocalObjectReference: reference, Key: source.Key, Optional: &optional,
+				},
+			},
+		})
+	}
+
+	for _, source := range model.Env_from_secrets {
+		optional := source.Optional
+		reference := apiv1.LocalObjectReference{Name: source.Name}
+		if source.Key == "" {
+			container.EnvFrom = append(container.EnvFrom, apiv1.EnvFromSource{
+				Prefix:    source.Prefix,
+				SecretRef: &apiv1.SecretEnvSource{LocalObjectReference: reference, Optional: &optional},
+			})
+			continue
+		}
+		container.Env = append(container.Env, apiv1.EnvVar{
+			Name: source.envName(),
+			ValueFrom: &apiv1.EnvVarSource{
+				SecretKeyRef: &apiv1.SecretKeySelector{
+					LocalObjectReference: reference, Key: source.Key, Optional: &optional,
+				},
+			},
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	ErrorBadRequest    = "BadRequest"
+	ErrorUnauthorized  = "Unauthorized"
+	ErrorForbidden     = "Forbidden"
+	ErrorNotFound      = "NotFound"
+	ErrorConflict      = "Conflict"
+	ErrorAlreadyExists = "AlreadyExists"
+	ErrorApplyConflict = "ApplyConflict"
+	ErrorInvalid       = "Invalid"
+	ErrorTooMany       = "TooManyRequests"
+	ErrorInternal      = "Internal"
+	ErrorUnavailable   = "Unavailable"
+	ErrorTimeout       = "Timeout"
+	ErrorDeployFailed  = "DeployFailed"
+	ErrorRolloutFailed = "RolloutFailed"
+)
+
+// errorStatus is the HTTP status each error code is answered with.
+var errorStatus = map[string]int{
+	ErrorBadRequest:    400,
+	ErrorUnauthorized:  401,
+	ErrorForbidden:     403,
+	ErrorNotFound:      404,
+	ErrorConflict:      409,
+	ErrorAlreadyExists: 409,
+	ErrorApplyConflict: 409,
+	ErrorInvalid:       422,
+	ErrorTooMany:       429,
+	ErrorInternal:      500,
+	ErrorUnavailable:   503,
+	ErrorTimeout:       504,
+	ErrorDeployFailed:  400,
+	ErrorRolloutFailed: 504,
+}
+
+// APIError is the body of every error response. Kind and Name identify the
+// resource that failed, Field the request field that was rejected and Reason
+// is the Kubernetes status reason behind it, when there is one.
+type APIError struct {
+	Status  int `json:"-"`
+	Code    string
+	Message string
+	Kind    string      `json:",omitempty"`
+	Name    string      `json:",omitempty"`
+	Field   string      `json:",omitempty"`
+	Reason  string      `json:",omitempty"`
+	Errors  []*APIError `json:",omitempty"`
+	Details interface{} `json:",omitempty"`
+}
+
+func (apiErr *APIError) Error() string {
+	if apiErr.Field != "" {
+		return fmt.Sprintf("%s: %s", apiErr.Field, apiErr.Message)
+	}
+	if apiErr.Kind != "" {
+		return fmt.Sprintf("%s %s: %s", apiErr.Kind, apiErr.Name, apiErr.Message)
+	}
+	return apiErr.Message
+}
+
+func NewAPIError(code, message string) *APIError {
+	return &APIError{Status: StatusForCode(code), Code: code, Message: message}
+}
+
+// StatusForCode returns the HTTP status of an error code.
+func StatusForCode(code string) int {
+	if status, ok := errorStatus[code]; ok {
+		return status
+	}
+	return 500
+}
+
+// CodeForStatus picks the error code for a bare HTTP status, as returned by
+// the router or the body parser.
+func CodeForStatus(status int) string {
+	switch status {
+	case 400:
+		return ErrorBadRequest
+	case 401:
+		return ErrorUnauthorized
+	case 403:
+		return ErrorForbidden
+	case 404:
+		return ErrorNotFound
+	case 409:
+		return ErrorConflict
+	case 422:
+		return ErrorInvalid
+	case 429:
+		return ErrorTooMany
+	case 503:
+		return ErrorUnavailable
+	case 504:
+		return ErrorTimeout
+	}
+	if status >= 400 && status < 500 {
+		return ErrorBadRequest
+	}
+	return ErrorInternal
+}
+
+// kubernetesCode maps a Kubernetes API error onto an error code.
+func kubernetesCode(err error) string {
+	switch {
+	case apierrors.IsNotFound(err):
+		return ErrorNotFound
+	case apierrors.IsAlreadyExists(err):
+		return ErrorAlreadyExists
+	case apierrors.IsConflict(err):
+		return ErrorConflict
+	case apierrors.IsForbidden(err):
+		return ErrorForbidden
+	case apierrors.IsUnauthorized(err):
+		return ErrorUnauthorized
+	case apierrors.IsInvalid(err):
+		return ErrorInvalid
+	case apierrors.IsBadRequest(err):
+		return ErrorBadRequest
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err):
+		return ErrorTimeout
+	case apierrors.IsTooManyRequests(err):
+		return ErrorTooMany
+	case apierrors.IsServiceUnavailable(err):
+		return ErrorUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	}
+	return ErrorInternal
+}
+
+// ResourceError classifies err as a failure of the named resource. It
+// returns nil for a nil error.
+func ResourceError(kind, name string, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	classified := ClassifyError(err)
+	classified.Kind = kind
+	classified.Name = name
+
+	return classified
+}
+
+// ClassifyError turns any error into an APIError. Errors of the deploy
+// pipeline keep their structured detail, Kubernetes API errors get the
+// status code that matches their reason and anything else is internal.
+func ClassifyError(err error) *APIError {
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var deployFailure *DeployFailure
+	if errors.As(err, &deployFailure) {
+		classified := NewAPIError(ErrorDeployFailed, err.Error())
+		classified.Name = deployFailure.Endpoint
+		classified.Details = deployFailure
+		if len(deployFailure.Failed) > 0 {
+			classified.Status = StatusForCode(deployFailure.Failed[0].Code)
+		}
+		return classified
+	}
+
+	var rolloutFailure *RolloutFailure
+	if errors.As(err, &rolloutFailure) {
+		// A Deployment past its progress deadline has given up on its own,
+		// which is a failed deploy rather than a slow one.
+		code := ErrorRolloutFailed
+		if rolloutFailure.Deadline_exceeded {
+			code = ErrorDeployFailed
+		}
+		classified := NewAPIError(code, err.Error())
+		classified.Kind = "Deployment"
+		classified.Name = rolloutFailure.Deployment
+		classified.Reason = rolloutFailure.Reason
+		classified.Details = rolloutFailure
+		return classified
+	}
+
+	var conflict *ApplyConflict
+	if errors.As(err, &conflict) {
+		classified := NewAPIError(ErrorApplyConflict, err.Error())
+		classified.Kind = conflict.Kind
+		classified.Name = conflict.Name
+		classified.Reason = string(apierrors.ReasonForError(err))
+		classified.Details = conflict.Conflicts
+		return classified
+	}
+
+	if errors.Is(err, ErrQueueFull) {
+		return NewAPIError(ErrorUnavailable, err.Error())
+	}
+
+	classified := NewAPIError(kubernetesCode(err), err.Error())
+
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		classified.Message = status.Status().Message
+		classified.Reason = string(status.Status().Reason)
+		if details := status.Status().Details; details != nil {
+			classified.Kind = details.Kind
+			classified.Name = details.Name
+		}
+	}
+
+	return classified
+}
+
+// JoinErrors combines the errors of steps that ran together. A single error
+// is returned as it is; several share a status code only when they agree on
+// one and answer 400 otherwise.
+func JoinErrors(errs []error) error {
+
+	classified := make([]*APIError, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			classified = append(classified, ClassifyError(err))
+		}
+	}
+
+	switch len(classified) {
+	case 0:
+		return nil
+	case 1:
+		return classified[0]
+	}
+
+	messages := make([]string, 0, len(classified))
+	joined := &APIError{Status: classified[0].Status, Code: classified[0].Code, Errors: classified}
+	for _, apiErr := range classified {
+		messages = append(messages, apiErr.Error())
+		if apiErr.Status != joined.Status {
+			joined.Status = 400
+			joined.Code = ErrorBadRequest
+		}
+	}
+	joined.Message = strings.Join(messages, "; ")
+
+	return joined
+}
+
+func CreateErrorResponse(apiErr *APIError) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(apiErr)
+
+	return message_parsed, error
+}
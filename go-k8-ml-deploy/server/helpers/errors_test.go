@@ -0,0 +1,146 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestCodeForStatus(t *testing.T) {
+
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{400, ErrorBadRequest},
+		{401, ErrorUnauthorized},
+		{403, ErrorForbidden},
+		{404, ErrorNotFound},
+		{409, ErrorConflict},
+		{422, ErrorInvalid},
+		{429, ErrorTooMany},
+		{503, ErrorUnavailable},
+		{504, ErrorTimeout},
+		{418, ErrorBadRequest},
+		{500, ErrorInternal},
+		{502, ErrorInternal},
+	}
+
+	for _, test := range tests {
+		if code := CodeForStatus(test.status); code != test.code {
+			t.Errorf("CodeForStatus(%d) = %s, want %s", test.status, code, test.code)
+		}
+	}
+}
+
+func TestStatusForCode(t *testing.T) {
+
+	tests := []struct {
+		code   string
+		status int
+	}{
+		{ErrorInvalid, 422},
+		{ErrorApplyConflict, 409},
+		{ErrorUnavailable, 503},
+		{ErrorRolloutFailed, 504},
+		{"Unknown", 500},
+	}
+
+	for _, test := range tests {
+		if status := StatusForCode(test.code); status != test.status {
+			t.Errorf("StatusForCode(%s) = %d, want %d", test.code, status, test.status)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+
+	resource := schema.GroupResource{Group: "apps", Resource: "deployments"}
+
+	tests := []struct {
+		name   string
+		err    error
+		code   string
+		status int
+	}{
+		{"not found", apierrors.NewNotFound(resource, "model"), ErrorNotFound, 404},
+		{"already exists", apierrors.NewAlreadyExists(resource, "model"), ErrorAlreadyExists, 409},
+		{"conflict", apierrors.NewConflict(resource, "model", errors.New("changed")), ErrorConflict, 409},
+		{"forbidden", apierrors.NewForbidden(resource, "model", errors.New("denied")), ErrorForbidden, 403},
+		{"invalid", apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "model", nil), ErrorInvalid, 422},
+		{"too many requests", apierrors.NewTooManyRequests("slow down", 1), ErrorTooMany, 429},
+		{"unavailable", apierrors.NewServiceUnavailable("down"), ErrorUnavailable, 503},
+		{"deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), ErrorTimeout, 504},
+		{"queue full", ErrQueueFull, ErrorUnavailable, 503},
+		{"api error", fieldError("image", "is required"), ErrorInvalid, 422},
+		{"wrapped api error", fmt.Errorf("deploy: %w", NewAPIError(ErrorConflict, "paused")), ErrorConflict, 409},
+		{"plain", errors.New("boom"), ErrorInternal, 500},
+		{"rollout timeout", &RolloutFailure{Deployment: "model"}, ErrorRolloutFailed, 504},
+		{"progress deadline", &RolloutFailure{Deployment: "model", Deadline_exceeded: true}, ErrorDeployFailed, 400},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			classified := ClassifyError(test.err)
+			if classified.Code != test.code || classified.Status != test.status {
+				t.Errorf("ClassifyError() = %s %d, want %s %d",
+					classified.Code, classified.Status, test.code, test.status)
+			}
+		})
+	}
+}
+
+func TestResourceError(t *testing.T) {
+
+	if err := ResourceError("Service", "model", nil); err != nil {
+		t.Errorf("ResourceError(nil) = %v, want nil", err)
+	}
+
+	err := ResourceError("Service", "model", errors.New("boom"))
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("ResourceError() = %T, want *APIError", err)
+	}
+	if apiErr.Kind != "Service" || apiErr.Name != "model" || apiErr.Code != ErrorInternal {
+		t.Errorf("ResourceError() = %+v, want an internal Service model error", apiErr)
+	}
+}
+
+func TestJoinErrors(t *testing.T) {
+
+	notFound := NewAPIError(ErrorNotFound, "missing")
+	invalid := NewAPIError(ErrorInvalid, "bad")
+
+	tests := []struct {
+		name   string
+		errs   []error
+		code   string
+		status int
+		count  int
+	}{
+		{"single", []error{nil, invalid}, ErrorInvalid, 422, 0},
+		{"same status", []error{notFound, NewAPIError(ErrorNotFound, "gone")}, ErrorNotFound, 404, 2},
+		{"mixed status", []error{notFound, invalid}, ErrorBadRequest, 400, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			joined, ok := JoinErrors(test.errs).(*APIError)
+			if !ok {
+				t.Fatalf("JoinErrors() is not an *APIError")
+			}
+			if joined.Code != test.code || joined.Status != test.status || len(joined.Errors) != test.count {
+				t.Errorf("JoinErrors() = %s %d with %d errors, want %s %d with %d",
+					joined.Code, joined.Status, len(joined.Errors), test.code, test.status, test.count)
+			}
+		})
+	}
+
+	if err := JoinErrors([]error{nil}); err != nil {
+		t.Errorf("JoinErrors(nil) = %v, want nil", err)
+	}
+}
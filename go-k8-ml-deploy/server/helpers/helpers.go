@@ -3,18 +3,23 @@ package helpers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	autoscalingv2ac "k8s.io/client-go/applyconfigurations/autoscaling/v2"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
 	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	hpav2 "k8s.io/client-go/kubernetes/typed/autoscaling/v2"
 	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	ingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
-	"k8s.io/client-go/util/retry"
 
 	"regexp"
+	"strconv"
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -23,69 +28,143 @@ import (
 	networkingv1 "k8s.io/api/networking/v1"
 )
 
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "go-k8-ml-deploy"
+	endpointLabel  = "mlops.iolap.com/endpoint"
+	versionLabel   = "mlops.iolap.com/canary-version"
+)
+
+// Limits and Requests take Kubernetes quantities such as "4Gi", "500m" or
+// "2". Memory and ephemeral storage without a suffix are bytes and a cpu
+// string without a suffix is cores. A cpu given as a bare number is in
+// millicores, as older clients send it.
 type Limits struct {
-	Memory *int `json:"memory"`
-	Cpu    *int `json:"cpu"`
-	Gpu    *int `json:"gpu"`
+	Memory            *resource.Quantity `json:"memory"`
+	Cpu               *resource.Quantity `json:"cpu"`
+	Ephemeral_storage *resource.Quantity `json:"ephemeral_storage"`
+
+	// Gpu is kept for older clients; use Accelerator instead.
+	Gpu *int `json:"gpu"`
 }
 
 type Requests struct {
-	Memory *int `json:"memory"`
-	Cpu    *int `json:"cpu"`
-	Gpu    *int `json:"gpu"`
+	Memory            *resource.Quantity `json:"memory"`
+	Cpu               *resource.Quantity `json:"cpu"`
+	Ephemeral_storage *resource.Quantity `json:"ephemeral_storage"`
+
+	// Gpu is kept for older clients; use Accelerator instead.
+	Gpu *int `json:"gpu"`
 }
 
 type ModelDeploy struct {
-	Model_names    []string `json:"model_names"`
-	Endpoint       string   `json:"endpoint"`
-	Image          string   `json:"image"`
-	Canary         bool     `json:"canary"`
-	Canary_weight  *string  `json:"canary_weight"`
-	Canary_version *string  `json:"canary_version"`
-	Model_stage    string   `json:"model_stage"`
-	Limits         Limits   `json:"limits"`
-	Requests       Requests `json:"requests"`
+	Model_names     []string     `json:"model_names"`
+	Endpoint        string       `json:"endpoint"`
+	Image           string       `json:"image"`
+	Canary          bool         `json:"canary"`
+	Canary_weight   *string      `json:"canary_weight"`
+	Canary_version  *string      `json:"canary_version"`
+	Model_stage     string       `json:"model_stage"`
+	Namespace       string       `json:"namespace"`
+	Async           bool         `json:"async"`
+	Wait            bool         `json:"wait"`
+	Timeout         *int         `json:"timeout"`
+	Dry_run         bool         `json:"dry_run"`
+	Output          string       `json:"output"`
+	Force_conflicts bool         `json:"force_conflicts"`
+	Limits          Limits       `json:"limits"`
+	Requests        Requests     `json:"requests"`
+	Accelerator     *Accelerator `json:"accelerator"`
+	Scheduling      *Scheduling  `json:"scheduling"`
+	Probes          *Probes      `json:"probes"`
+	Ports           []Port       `json:"ports"`
+	Artifacts       *Artifacts   `json:"artifacts"`
+	Autoscaling     *Autoscaling `json:"autoscaling"`
+
+	Image_pull_policy  string    `json:"image_pull_policy"`
+	Image_pull_secrets []string  `json:"image_pull_secrets"`
+	Resolve_digest     bool      `json:"resolve_digest"`
+	Strategy           *Strategy `json:"strategy"`
+	Service_account    string    `json:"service_account"`
+
+	security *SecurityPolicy
+
+	imageDigest string
+
+	Env                 []EnvVar    `json:"env"`
+	Env_from_secrets    []EnvSource `json:"env_from_secrets"`
+	Env_from_configmaps []EnvSource `json:"env_from_configmaps"`
 }
 
 type ModelDestroy struct {
 	Endpoint       string  `json:"endpoint"`
 	Canary         bool    `json:"canary"`
 	Canary_version *string `json:"canary_version"`
+	Namespace      string  `json:"namespace"`
+	Dry_run        bool    `json:"dry_run"`
+	Output         string  `json:"output"`
 }
 
 type ModelTransition struct {
 	Endpoint       string  `json:"endpoint"`
 	Canary_version *string `json:"canary_version"`
+	Namespace      string  `json:"namespace"`
+	Wait           bool    `json:"wait"`
+	Timeout        *int    `json:"timeout"`
+	Dry_run        bool    `json:"dry_run"`
+	Output         string  `json:"output"`
 }
 
 type DeployReturn struct {
 	Endpoint       string
+	Namespace      string
 	Canary         bool
 	Canary_version string
+	Image          string
+	Image_digest   string          `json:",omitempty"`
+	Rollout        *EndpointStatus `json:",omitempty"`
 }
 
 type DestroyReturn struct {
 	Deleted        string
+	Namespace      string
 	Canary         bool
 	Canary_version string
 }
 
 type TransReturn struct {
 	Transition string
+	Namespace  string
+	Rollout    *EndpointStatus `json:",omitempty"`
 }
 
 func (model *ModelDeploy) InitModelDefaults() {
-	model.Image = "000000000000.dkr.ecr.us-east-1.amazonaws.com/name:latest"
 	model.Model_stage = "Production"
 }
 
-func (model *ModelDeploy) ParseModelParams() (string, string, error) {
+func (model *ModelDeploy) canaryVersion() string {
+	if model.Canary_version != nil {
+		return *model.Canary_version
+	}
+	return ""
+}
 
-	if model.Limits.Gpu != nil && model.Requests.Gpu != nil {
-		if *model.Limits.Gpu != *model.Requests.Gpu {
-			*model.Requests.Gpu = *model.Limits.Gpu
-		}
+func (model *ModelDeploy) dryRun() []string {
+	if model.Dry_run {
+		return []string{metav1.DryRunAll}
 	}
+	return nil
+}
+
+func managedLabels(endpoint, canary_version string) map[string]string {
+	return map[string]string{
+		managedByLabel: managedByValue,
+		endpointLabel:  endpoint,
+		versionLabel:   canary_version,
+	}
+}
+
+func (model *ModelDeploy) ParseModelParams() (string, string, error) {
 
 	model_names := strings.Join(model.Model_names, ",")
 
@@ -147,52 +226,48 @@ func (model *ModelTransition) ParseTransitionParams() (string, error) {
 		model.Endpoint = string(runes)
 	}
 
-	toDestroy := ""
-	if model.Canary_version != nil {
-		toDestroy = model.Endpoint + *model.Canary_version
+	if model.Canary_version == nil {
+		return "", errors.New("canary_version is required")
 	}
 
+	toDestroy := model.Endpoint + *model.Canary_version
+
 	return toDestroy, nil
 }
 
-func (model *ModelDeploy) initResources() (resources apiv1.ResourceRequirements) {
+// resourceList merges the quantities that were set into one ResourceList.
+func resourceList(memory, cpu, ephemeralStorage *resource.Quantity) apiv1.ResourceList {
 
-	resources = apiv1.ResourceRequirements{}
+	list := apiv1.ResourceList{}
 
-	if model.Limits.Memory != nil {
-		resources.Limits = apiv1.ResourceList{
-			apiv1.ResourceName("memory"): *resource.NewQuantity(int64(*model.Limits.Memory), resource.BinarySI),
-		}
+	if memory != nil {
+		list[apiv1.ResourceMemory] = *memory
 	}
 
-	if model.Limits.Cpu != nil {
-		resources.Limits = apiv1.ResourceList{
-			apiv1.ResourceName("cpu"): *resource.NewMilliQuantity(int64(*model.Limits.Cpu), resource.DecimalSI),
-		}
+	if cpu != nil {
+		list[apiv1.ResourceCPU] = *cpu
 	}
 
-	if model.Limits.Gpu != nil {
-		resources.Limits = apiv1.ResourceList{
-			apiv1.ResourceName("nvidia.com/gpu"): *resource.NewMilliQuantity(int64(*model.Limits.Gpu), resource.DecimalSI),
-		}
+	if ephemeralStorage != nil {
+		list[apiv1.ResourceEphemeralStorage] = *ephemeralStorage
 	}
 
-	if model.Requests.Memory != nil {
-		resources.Requests = apiv1.ResourceList{
-			apiv1.ResourceName("memory"): *resource.NewQuantity(int64(*model.Requests.Memory), resource.BinarySI),
-		}
+	if len(list) == 0 {
+		return nil
 	}
 
-	if model.Requests.Cpu != nil {
-		resources.Requests = apiv1.ResourceList{
-			apiv1.ResourceName("cpu"): *resource.NewMilliQuantity(int64(*model.Requests.Cpu), resource.DecimalSI),
-		}
-	}
+	return list
+}
 
-	if model.Requests.Gpu != nil {
-		resources.Requests = apiv1.ResourceList{
-			apiv1.ResourceName("nvidia.com/gpu"): *resource.NewMilliQuantity(int64(*model.Requests.Gpu), resource.DecimalSI),
-		}
+func (model *ModelDeploy) initResources() (resources apiv1.ResourceRequirements) {
+
+	resources = apiv1.ResourceRequirements{
+		Limits: model.Accelerator.addTo(
+			resourceList(model.Limits.Memory, model.Limits.Cpu, model.Limits.Ephemeral_storage),
+		),
+		Requests: model.Accelerator.addTo(
+			resourceList(model.Requests.Memory, model.Requests.Cpu, model.Requests.Ephemeral_storage),
+		),
 	}
 
 	return
@@ -207,15 +282,19 @@ func newDeployment(model *ModelDeploy, model_names, endpoint string) *appsv1.Dep
 		canary_version = ""
 	}
 
+	labels := managedLabels(endpoint, canary_version)
+	labels["app"] = endpoint + canary_version
+
 	deployment := &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      endpoint + canary_version,
-			Namespace: "namespace",
-			Labels: map[string]string{
-				"app": endpoint + canary_version,
-			},
+			Name:        endpoint + canary_version,
+			Namespace:   model.Namespace,
+			Labels:      labels,
+			Annotations: model.imageAnnotations(),
 		},
 		Spec: appsv1.DeploymentSpec{
+			Replicas: model.replicas(),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": endpoint + canary_version,
@@ -223,22 +302,17 @@ func newDeployment(model *ModelDeploy, model_names, endpoint string) *appsv1.Dep
 			},
 			Template: apiv1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": endpoint + canary_version,
-					},
+					Labels:      labels,
+					Annotations: model.scrapeAnnotations(),
 				},
 				Spec: apiv1.PodSpec{
+					ImagePullSecrets: model.pullSecrets(),
 					Containers: []apiv1.Container{
 						{
 							Name:            endpoint + canary_version,
 							Image:           model.Image,
-							ImagePullPolicy: apiv1.PullPolicy("Always"),
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          endpoint + canary_version,
-									ContainerPort: 8080,
-								},
-							},
+							ImagePullPolicy: model.pullPolicy(),
+							Ports:           model.containerPorts(endpoint + canary_version),
 							Env: []apiv1.EnvVar{
 								{Name: "MODEL_NAMES", Value: model_names},
 								{Name: "ENDPOINT", Value: endpoint},
@@ -252,6 +326,15 @@ func newDeployment(model *ModelDeploy, model_names, endpoint string) *appsv1.Dep
 		},
 	}
 
+	deployment.Annotations[modelConfigAnnotation] = model.configAnnotation()
+
+	model.applyScheduling(&deployment.Spec.Template.Spec, deployment.Name)
+	model.applyProbes(&deployment.Spec.Template.Spec.Containers[0], int(model.inferencePort().Container_port))
+	model.applyEnv(&deployment.Spec.Template.Spec.Containers[0])
+	model.applyArtifacts(&deployment.Spec.Template.Spec, &deployment.Spec.Template.Spec.Containers[0])
+	model.applyStrategy(&deployment.Spec)
+	model.applySecurity(&deployment.Spec.Template.Spec)
+
 	return deployment
 }
 
@@ -265,22 +348,17 @@ func newService(model *ModelDeploy, endpoint string) *apiv1.Service {
 	}
 
 	service := &apiv1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      endpoint + canary_version,
-			Namespace: "namespace",
+			Namespace: model.Namespace,
+			Labels:    managedLabels(endpoint, canary_version),
 		},
 		Spec: apiv1.ServiceSpec{
 			Selector: map[string]string{
 				"app": endpoint + canary_version,
 			},
-			Ports: []apiv1.ServicePort{
-				{
-					Name:       endpoint + canary_version,
-					Protocol:   apiv1.ProtocolTCP,
-					Port:       8080,
-					TargetPort: intstr.FromString(endpoint + canary_version),
-				},
-			},
+			Ports: model.servicePorts(endpoint + canary_version),
 		},
 	}
 
@@ -322,9 +400,11 @@ func newIngress(model *ModelDeploy, endpoint string) *networkingv1.Ingress {
 	*ingressPath = networkingv1.PathTypePrefix
 
 	ingress := &networkingv1.Ingress{
+		TypeMeta: metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "Ingress"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        endpoint + canary_version,
-			Namespace:   "namespace",
+			Namespace:   model.Namespace,
+			Labels:      managedLabels(endpoint, canary_version),
 			Annotations: annotations,
 		},
 		Spec: networkingv1.IngressSpec{
@@ -341,7 +421,7 @@ func newIngress(model *ModelDeploy, endpoint string) *networkingv1.Ingress {
 										Service: &networkingv1.IngressServiceBackend{
 											Name: endpoint + canary_version,
 											Port: networkingv1.ServiceBackendPort{
-												Number: 8080,
+												Number: model.inferencePort().servicePort(),
 											},
 										},
 									},
@@ -366,16 +446,12 @@ func newHpa(model *ModelDeploy, endpoint string) *autoscalingv2.HorizontalPodAut
 		canary_version = ""
 	}
 
-	minScale := new(int32)
-	*minScale = 1
-
-	cpuPercent := new(int32)
-	*cpuPercent = 50
-
 	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		TypeMeta: metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      endpoint,
-			Namespace: "namespace",
+			Name:      endpoint + canary_version,
+			Namespace: model.Namespace,
+			Labels:    managedLabels(endpoint, canary_version),
 		},
 		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
 			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
@@ -383,230 +459,402 @@ func newHpa(model *ModelDeploy, endpoint string) *autoscalingv2.HorizontalPodAut
 				APIVersion: "apps/v1",
 				Name:       endpoint + canary_version,
 			},
-			MinReplicas: minScale,
-			MaxReplicas: 10,
-			Metrics: []autoscalingv2.MetricSpec{
-				{
-					Type: autoscalingv2.MetricSourceType("Resource"),
-					Resource: &autoscalingv2.ResourceMetricSource{
-						Name: apiv1.ResourceName("cpu"),
-						Target: autoscalingv2.MetricTarget{
-							Type:               autoscalingv2.MetricTargetType("Utilization"),
-							AverageUtilization: cpuPercent,
-						},
-					},
-				},
-			},
 		},
 	}
 
+	model.applyAutoscaling(hpa)
+
 	return hpa
 }
 
 func CrudDeployment(
+	ctx context.Context,
 	deploymentsClient v1.DeploymentInterface,
 	model *ModelDeploy,
 	model_names, endpoint string,
-	crudChannel chan error,
-) {
+	tx *DeployTransaction,
+) error {
 
 	deployment := newDeployment(model, model_names, endpoint)
 
-	_, getErr := deploymentsClient.Get(context.TODO(), endpoint, metav1.GetOptions{})
-
-	if getErr != nil {
-		if strings.HasSuffix(getErr.Error(), "not found") {
-			fmt.Println("Creating deployment...")
-			result, err := deploymentsClient.Create(
-				context.TODO(), deployment, metav1.CreateOptions{},
-			)
-			if err != nil {
-				crudChannel <- err
-				return
-			}
-			fmt.Printf("Created deployment %q.\n", result.GetObjectMeta().GetName())
-		} else {
-			crudChannel <- getErr
-			return
+	existing, getErr := deploymentsClient.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
+
+	// An existing Deployment is recorded before it is touched, since
+	// switching to Recreate takes two writes.
+	if getErr == nil {
+		tx.recordUpdate("Deployment", deployment.Name, func(ctx context.Context) error {
+			return restoreDeployment(ctx, deploymentsClient, existing)
+		})
+	}
+
+	// A deploy does not undo a pause or a manual scale of a Deployment with a
+	// fixed replica count: the new count is what it gets back afterwards.
+	if getErr == nil && deployment.Spec.Replicas != nil {
+		replicas := strconv.Itoa(int(*deployment.Spec.Replicas))
+		if _, paused := existing.Annotations[pausedAnnotation]; paused {
+			deployment.Annotations[pausedAnnotation] = replicas
+			deployment.Spec.Replicas = new(int32)
+		} else if existing.Annotations[scaleUntilAnnotation] != "" && existing.Spec.Replicas != nil {
+			deployment.Annotations[scaleRestoreAnnotation] = replicas
+			deployment.Spec.Replicas = existing.Spec.Replicas
 		}
-	} else {
-		fmt.Println("Updating deployment...")
-		updateResult, updateErr := deploymentsClient.Update(
-			context.TODO(), deployment, metav1.UpdateOptions{},
+	}
+
+	// The API server keeps the defaulted rollingUpdate settings of a
+	// Deployment and rejects them once the type is Recreate, so they are
+	// cleared before switching.
+	recreate := deployment.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType
+	if getErr == nil && recreate && existing.Spec.Strategy.RollingUpdate != nil && !model.Dry_run {
+		_, err := deploymentsClient.Patch(
+			ctx, deployment.Name, types.MergePatchType,
+			[]byte(`{"spec":{"strategy":{"type":"Recreate","rollingUpdate":null}}}`),
+			metav1.PatchOptions{FieldManager: FieldManager},
 		)
-		if updateErr != nil {
-			crudChannel <- updateErr
-			return
+		if err != nil {
+			return err
 		}
-		fmt.Printf("Updated deployment %q.\n", updateResult.GetObjectMeta().GetName())
 	}
 
-	crudChannel <- nil
+	fmt.Println("Applying deployment...")
+	applyErr := applyObject(ctx, "Deployment", deployment.Name, deployment, model,
+		func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+			_, err := deploymentsClient.Patch(ctx, deployment.Name, types.ApplyPatchType, data, options)
+			return err
+		},
+	)
+	if applyErr != nil {
+		return applyErr
+	}
+	fmt.Printf("Applied deployment %q.\n", deployment.Name)
 
+	if getErr != nil {
+		tx.recordCreate("Deployment", deployment.Name, func(ctx context.Context) error {
+			return deploymentsClient.Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+		})
+	}
+
+	return nil
 }
 
 func CrudService(
+	ctx context.Context,
 	serviceClient corev1.ServiceInterface,
 	model *ModelDeploy,
 	endpoint string,
-	crudChannel chan error,
-) {
+	tx *DeployTransaction,
+) error {
 
 	service := newService(model, endpoint)
 
-	_, getErr := serviceClient.Get(context.TODO(), endpoint, metav1.GetOptions{})
+	existing, getErr := serviceClient.Get(ctx, service.Name, metav1.GetOptions{})
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
+
+	fmt.Println("Applying service...")
+	applyErr := applyObject(ctx, "Service", service.Name, service, model,
+		func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+			_, err := serviceClient.Patch(ctx, service.Name, types.ApplyPatchType, data, options)
+			return err
+		},
+	)
+	if applyErr != nil {
+		return applyErr
+	}
+	fmt.Printf("Applied service %q.\n", service.Name)
 
 	if getErr != nil {
-		if strings.HasSuffix(getErr.Error(), "not found") {
-			fmt.Println("Creating service...")
-			result, err := serviceClient.Create(
-				context.TODO(), service, metav1.CreateOptions{},
-			)
-			if err != nil {
-				crudChannel <- err
-				return
-			}
-			fmt.Printf("Created service %q.\n", result.GetObjectMeta().GetName())
-		} else {
-			crudChannel <- getErr
-			return
-		}
+		tx.recordCreate("Service", service.Name, func(ctx context.Context) error {
+			return serviceClient.Delete(ctx, service.Name, metav1.DeleteOptions{})
+		})
 	} else {
-		fmt.Println("Updating service...")
-		updateResult, updateErr := serviceClient.Update(
-			context.TODO(), service, metav1.UpdateOptions{},
-		)
-		if updateErr != nil {
-			crudChannel <- updateErr
-			return
+		tx.recordUpdate("Service", service.Name, func(ctx context.Context) error {
+			return restoreService(ctx, serviceClient, existing)
+		})
+	}
+
+	return nil
+}
+
+// transitionServiceApply builds the apply configuration that points the
+// stable Service of an endpoint at its canary deployment. It starts from the
+// fields this server already owns so applying it drops nothing else.
+func transitionServiceApply(
+	service *apiv1.Service, model *ModelTransition,
+) (*corev1ac.ServiceApplyConfiguration, error) {
+
+	config, err := corev1ac.ExtractService(service, FieldManager)
+	if err != nil {
+		return nil, err
+	}
+
+	target := model.Endpoint + *model.Canary_version
+
+	if config.Spec == nil {
+		config.WithSpec(corev1ac.ServiceSpec())
+	}
+	config.Spec.Selector = map[string]string{
+		"app": target,
+	}
+
+	if len(service.Spec.Ports) == 0 {
+		return config, nil
+	}
+
+	// The inference port carries the name of the stable deployment and is
+	// the only one retargeted; other ports keep their names, which the
+	// canary containers share.
+	stable := service.Spec.Ports[0]
+	for _, port := range service.Spec.Ports {
+		if port.Name == model.Endpoint {
+			stable = port
+		}
+	}
+	for i := range config.Spec.Ports {
+		port := &config.Spec.Ports[i]
+		if port.Port != nil && *port.Port == stable.Port && (port.Protocol == nil || *port.Protocol == stable.Protocol) {
+			port.WithName(model.Endpoint).WithTargetPort(intstr.FromString(target))
+			return config, nil
 		}
-		fmt.Printf("Updated service %q.\n", updateResult.GetObjectMeta().GetName())
 	}
 
-	crudChannel <- nil
+	config.Spec.WithPorts(corev1ac.ServicePort().
+		WithName(model.Endpoint).
+		WithProtocol(stable.Protocol).
+		WithPort(stable.Port).
+		WithTargetPort(intstr.FromString(target)))
 
+	return config, nil
 }
 
 func TransitionService(
-	serviceClient corev1.ServiceInterface, model *ModelTransition, toDestroy string,
+	ctx context.Context, serviceClient corev1.ServiceInterface, model *ModelTransition, toDestroy string,
 ) error {
 
-	fmt.Println("Updating deployment...")
+	fmt.Println("Applying service...")
 
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		// Retrieve the latest version of Deployment before attempting update
-		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		service, getErr := serviceClient.Get(context.TODO(), model.Endpoint, metav1.GetOptions{})
-		if getErr != nil {
-			return getErr
-		}
-		service.Spec.Selector = map[string]string{
-			"app": model.Endpoint + *model.Canary_version,
-		}
-		service.Spec.Ports[0].Name = model.Endpoint
-		service.Spec.Ports[0].TargetPort = intstr.FromString(model.Endpoint + *model.Canary_version)
-		_, updateErr := serviceClient.Update(context.TODO(), service, metav1.UpdateOptions{})
-		return updateErr
-	})
+	service, getErr := serviceClient.Get(ctx, model.Endpoint, metav1.GetOptions{})
+	if getErr != nil {
+		return ResourceError("Service", model.Endpoint, getErr)
+	}
+
+	config, err := transitionServiceApply(service, model)
+	if err != nil {
+		return ResourceError("Service", model.Endpoint, err)
+	}
+
+	// The transition is an explicit request to repoint the endpoint, so it
+	// takes the selector over from whoever set it last.
+	_, applyErr := serviceClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+	if applyErr != nil {
+		return ResourceError("Service", model.Endpoint, applyErr)
+	}
+
+	fmt.Printf("Applied service %q.\n", model.Endpoint)
+
+	return nil
+}
+
+// transitionHpaApply gives the HPA of a canary that was scaled with its
+// traffic weight back the bounds it has at full traffic. It returns nil when
+// the HPA was not scaled.
+func transitionHpaApply(
+	hpa *autoscalingv2.HorizontalPodAutoscaler,
+) (*autoscalingv2ac.HorizontalPodAutoscalerApplyConfiguration, error) {
+
+	minValue, hasMin := hpa.Annotations[minReplicasAnnotation]
+	maxValue, hasMax := hpa.Annotations[maxReplicasAnnotation]
+	if !hasMin || !hasMax {
+		return nil, nil
+	}
+
+	minReplicas, err := strconv.Atoi(minValue)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %w", minReplicasAnnotation, err)
+	}
+	maxReplicas, err := strconv.Atoi(maxValue)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %w", maxReplicasAnnotation, err)
+	}
+
+	config, err := autoscalingv2ac.ExtractHorizontalPodAutoscaler(hpa, FieldManager)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(config.Annotations, minReplicasAnnotation)
+	delete(config.Annotations, maxReplicasAnnotation)
+	if config.Spec == nil {
+		config.WithSpec(autoscalingv2ac.HorizontalPodAutoscalerSpec())
+	}
+	config.Spec.WithMinReplicas(int32(minReplicas)).WithMaxReplicas(int32(maxReplicas))
+
+	return config, nil
+}
+
+// TransitionHpa scales the HPA of a promoted canary up to the bounds it has
+// at full traffic.
+func TransitionHpa(
+	ctx context.Context, hpaClient hpav2.HorizontalPodAutoscalerInterface, toDestroy string,
+) error {
+
+	hpa, getErr := hpaClient.Get(ctx, toDestroy, metav1.GetOptions{})
+	if apierrors.IsNotFound(getErr) {
+		return nil
+	}
+	if getErr != nil {
+		return ResourceError("HorizontalPodAutoscaler", toDestroy, getErr)
+	}
 
-	if retryErr != nil {
-		return retryErr
+	config, err := transitionHpaApply(hpa)
+	if err != nil {
+		return ResourceError("HorizontalPodAutoscaler", toDestroy, err)
+	}
+	if config == nil {
+		return nil
 	}
 
-	fmt.Println("Updated deployment...")
+	fmt.Println("Applying hpa...")
+	_, applyErr := hpaClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+	if applyErr != nil {
+		return ResourceError("HorizontalPodAutoscaler", toDestroy, applyErr)
+	}
+	fmt.Printf("Applied hpa %q.\n", toDestroy)
 
 	return nil
 }
 
 func CrudIngress(
+	ctx context.Context,
 	ingressClient ingv1.IngressInterface,
 	model *ModelDeploy,
 	endpoint string,
-	crudChannel chan error,
-) {
+	tx *DeployTransaction,
+) error {
 
 	ingress := newIngress(model, endpoint)
 
-	_, getErr := ingressClient.Get(context.TODO(), endpoint, metav1.GetOptions{})
+	existing, getErr := ingressClient.Get(ctx, ingress.Name, metav1.GetOptions{})
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
+
+	fmt.Println("Applying ingress...")
+	applyErr := applyObject(ctx, "Ingress", ingress.Name, ingress, model,
+		func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+			_, err := ingressClient.Patch(ctx, ingress.Name, types.ApplyPatchType, data, options)
+			return err
+		},
+	)
+	if applyErr != nil {
+		return applyErr
+	}
+	fmt.Printf("Applied ingress %q.\n", ingress.Name)
 
 	if getErr != nil {
-		if strings.HasSuffix(getErr.Error(), "not found") {
-			fmt.Println("Creating ingress...")
-			result, err := ingressClient.Create(
-				context.TODO(), ingress, metav1.CreateOptions{},
-			)
-			if err != nil {
-				crudChannel <- err
-				return
-			}
-			fmt.Printf("Created ingress %q.\n", result.GetObjectMeta().GetName())
-		} else {
-			crudChannel <- getErr
-			return
-		}
+		tx.recordCreate("Ingress", ingress.Name, func(ctx context.Context) error {
+			return ingressClient.Delete(ctx, ingress.Name, metav1.DeleteOptions{})
+		})
 	} else {
-		fmt.Println("Updating ingress...")
-		updateResult, updateErr := ingressClient.Update(
-			context.TODO(), ingress, metav1.UpdateOptions{},
-		)
-		if updateErr != nil {
-			crudChannel <- updateErr
-			return
-		}
-		fmt.Printf("Updated ingress %q.\n", updateResult.GetObjectMeta().GetName())
+		tx.recordUpdate("Ingress", ingress.Name, func(ctx context.Context) error {
+			return restoreIngress(ctx, ingressClient, existing)
+		})
 	}
 
-	crudChannel <- nil
-
+	return nil
 }
 
 func CrudHpa(
+	ctx context.Context,
 	hpaClient hpav2.HorizontalPodAutoscalerInterface,
 	model *ModelDeploy,
 	endpoint string,
+	tx *DeployTransaction,
 ) error {
 
 	hpa := newHpa(model, endpoint)
 
-	_, getErr := hpaClient.Get(context.TODO(), endpoint, metav1.GetOptions{})
+	existing, getErr := hpaClient.Get(ctx, hpa.Name, metav1.GetOptions{})
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
 
-	if getErr != nil {
-		if strings.HasSuffix(getErr.Error(), "not found") {
-			fmt.Println("Creating hpa...")
-			result, err := hpaClient.Create(
-				context.TODO(), hpa, metav1.CreateOptions{},
-			)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("Created hpa %q.\n", result.GetObjectMeta().GetName())
-		} else {
-			return getErr
+	if !model.usesHpa() {
+		if getErr != nil || existing.Spec.ScaleTargetRef.Name != hpa.Spec.ScaleTargetRef.Name {
+			return nil
 		}
+		return removeHpa(ctx, hpaClient, model, existing, tx)
+	}
+
+	fmt.Println("Applying hpa...")
+	applyErr := applyObject(ctx, "HorizontalPodAutoscaler", hpa.Name, hpa, model,
+		func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+			_, err := hpaClient.Patch(ctx, hpa.Name, types.ApplyPatchType, data, options)
+			return err
+		},
+	)
+	if applyErr != nil {
+		return applyErr
+	}
+	fmt.Printf("Applied hpa %q.\n", hpa.Name)
+
+	if getErr != nil {
+		tx.recordCreate("HorizontalPodAutoscaler", hpa.Name, func(ctx context.Context) error {
+			return hpaClient.Delete(ctx, hpa.Name, metav1.DeleteOptions{})
+		})
 	} else {
-		fmt.Println("Updating hpa...")
-		updateResult, updateErr := hpaClient.Update(
-			context.TODO(), hpa, metav1.UpdateOptions{},
-		)
-		if updateErr != nil {
-			return updateErr
-		}
-		fmt.Printf("Updated hpa %q.\n", updateResult.GetObjectMeta().GetName())
+		tx.recordUpdate("HorizontalPodAutoscaler", hpa.Name, func(ctx context.Context) error {
+			return restoreHpa(ctx, hpaClient, existing)
+		})
+	}
+
+	return nil
+}
+
+// removeHpa deletes the HPA of a model whose autoscaling was turned off or
+// moved to KEDA. A rollback creates it again as it was.
+func removeHpa(
+	ctx context.Context,
+	hpaClient hpav2.HorizontalPodAutoscalerInterface,
+	model *ModelDeploy,
+	existing *autoscalingv2.HorizontalPodAutoscaler,
+	tx *DeployTransaction,
+) error {
+
+	fmt.Println("Deleting hpa...")
+	if err := hpaClient.Delete(ctx, existing.Name, metav1.DeleteOptions{DryRun: model.dryRun()}); err != nil {
+		return err
 	}
+	fmt.Printf("Deleted hpa %q.\n", existing.Name)
+
+	tx.recordUpdate("HorizontalPodAutoscaler", existing.Name, func(ctx context.Context) error {
+		return recreateHpa(ctx, hpaClient, existing)
+	})
 
 	return nil
 }
 
-func CreateResponse(model *ModelDeploy, endpoint string) ([]byte, error) {
+func NewDeployReturn(model *ModelDeploy, endpoint string) *DeployReturn {
 
 	message := new(DeployReturn)
 	message.Endpoint = endpoint
+	message.Namespace = model.Namespace
 	message.Canary = model.Canary
+	message.Image = model.Image
+	message.Image_digest = model.imageDigest
 
 	if model.Canary_version != nil {
 		message.Canary_version = *model.Canary_version
 	}
 
+	return message
+}
+
+func CreateResponse(message *DeployReturn) ([]byte, error) {
+
 	message_parsed, error := json.Marshal(message)
 
 	return message_parsed, error
@@ -616,6 +864,7 @@ func CreateDestroyResponse(model *ModelDestroy, endpoint string) ([]byte, error)
 
 	message := new(DestroyReturn)
 	message.Deleted = "/invocations/" + endpoint
+	message.Namespace = model.Namespace
 	message.Canary = model.Canary
 
 	if model.Canary_version != nil {
@@ -627,43 +876,30 @@ func CreateDestroyResponse(model *ModelDestroy, endpoint string) ([]byte, error)
 	return message_parsed, error
 }
 
-func CreateTransResponse(endpoint string) ([]byte, error) {
+func CreateTransResponse(model *ModelTransition, rollout *EndpointStatus) ([]byte, error) {
 
 	message := new(TransReturn)
-	message.Transition = "/invocations/" + endpoint
+	message.Transition = "/invocations/" + model.Endpoint
+	message.Namespace = model.Namespace
+	message.Rollout = rollout
 
 	message_parsed, error := json.Marshal(message)
 
 	return message_parsed, error
 }
 
-func CheckErrors(channel chan error) (string, bool) {
+// CheckErrors waits for every goroutine writing to channel and combines the
+// errors they reported.
+func CheckErrors(channel chan error) error {
 
 	errorsSet := make([]error, 0)
-	i := 0
-	for {
-		crudErr := <-channel
-		i++
-		if crudErr != nil {
+	for i := 0; i < cap(channel); i++ {
+		if crudErr := <-channel; crudErr != nil {
 			errorsSet = append(errorsSet, crudErr)
 		}
-		if i == cap(channel) {
-			break
-		}
-
-	}
-
-	valueErr := ""
-	checkErr := false
-
-	for _, value := range errorsSet {
-		if value != nil {
-			valueErr += value.Error() + " \n"
-			checkErr = true
-		}
 	}
 
-	return valueErr, checkErr
+	return JoinErrors(errorsSet)
 }
 
 func DeleteDeployment(
@@ -674,7 +910,7 @@ func DeleteDeployment(
 	if err := deploymentsClient.Delete(context.TODO(), endpoint, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	}); err != nil {
-		deleteChannel <- err
+		deleteChannel <- ResourceError("Deployment", endpoint, err)
 		return
 	}
 	fmt.Println("Deleted deployment.")
@@ -689,7 +925,7 @@ func DeleteService(
 	if err := serviceClient.Delete(context.TODO(), endpoint, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	}); err != nil {
-		deleteChannel <- err
+		deleteChannel <- ResourceError("Service", endpoint, err)
 		return
 	}
 	fmt.Println("Deleted service.")
@@ -704,22 +940,35 @@ func DeleteIngress(
 	if err := ingressClient.Delete(context.TODO(), endpoint, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	}); err != nil {
-		deleteChannel <- err
+		deleteChannel <- ResourceError("Ingress", endpoint, err)
 		return
 	}
 	fmt.Println("Deleted ingress.")
 	deleteChannel <- nil
 }
 
+// DeleteHpa deletes the HPA of a version if it scales the target deployment.
+// A version deployed without autoscaling has none, and an HPA that scales
+// another deployment is left alone.
 func DeleteHpa(
-	hpaClient hpav2.HorizontalPodAutoscalerInterface, endpoint string, deleteChannel chan error,
+	hpaClient hpav2.HorizontalPodAutoscalerInterface, name, target string, deleteChannel chan error,
 ) {
 	fmt.Println("Deleting hpa...")
+	hpa, err := hpaClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && hpa.Spec.ScaleTargetRef.Name != target) {
+		fmt.Println("No hpa to delete.")
+		deleteChannel <- nil
+		return
+	}
+	if err != nil {
+		deleteChannel <- ResourceError("HorizontalPodAutoscaler", name, err)
+		return
+	}
 	deletePolicy := metav1.DeletePropagationForeground
-	if err := hpaClient.Delete(context.TODO(), endpoint, metav1.DeleteOptions{
+	if err := hpaClient.Delete(context.TODO(), name, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
-	}); err != nil {
-		deleteChannel <- err
+	}); err != nil && !apierrors.IsNotFound(err) {
+		deleteChannel <- ResourceError("HorizontalPodAutoscaler", name, err)
 		return
 	}
 	fmt.Println("Deleted hpa.")
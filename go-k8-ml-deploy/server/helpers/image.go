@@ -0,0 +1,412 @@
+package helpers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	dockerHubRegistry = "docker.io"
+	dockerHubHost     = "registry-1.docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+
+	imageDigestAnnotation = "mlops.iolap.com/image-digest"
+	changeCauseAnnotation = "kubernetes.io/change-cause"
+
+	registryTimeout = 30 * time.Second
+)
+
+// manifestTypes are the manifest media types a digest can be resolved for,
+// image indexes first so multi-arch images pin to the index.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// imageReference is an image split into registry, repository, tag and
+// digest, with Docker Hub defaults filled in.
+type imageReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+func parseImage(image string) (*imageReference, error) {
+
+	reference := &imageReference{registry: dockerHubRegistry}
+	name := image
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		reference.digest = name[i+1:]
+		name = name[:i]
+	}
+
+	if i := strings.Index(name, "/"); i >= 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			reference.registry = first
+			name = name[i+1:]
+		}
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i:], "/") {
+		reference.tag = name[i+1:]
+		name = name[:i]
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("%q is not an image reference", image)
+	}
+	if reference.registry == dockerHubRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if reference.tag == "" {
+		reference.tag = "latest"
+	}
+	reference.repository = name
+
+	return reference, nil
+}
+
+type registryCredentials struct {
+	username string
+	password string
+}
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// pullCredentials looks the registry up in the dockerconfigjson pull secrets
+// of the model.
+func pullCredentials(
+	ctx context.Context, clients *Clients, secrets []string, registry string,
+) (*registryCredentials, error) {
+
+	keys := []string{registry, "https://" + registry, "http://" + registry}
+	if registry == dockerHubRegistry {
+		keys = append(keys, dockerHubAuthKey)
+	}
+
+	for _, name := range secrets {
+		secret, err := clients.Secrets.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, ResourceError("Secret", name, err)
+		}
+
+		config := dockerConfig{}
+		if data, ok := secret.Data[apiv1.DockerConfigJsonKey]; ok {
+			if err := json.Unmarshal(data, &config); err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, err)
+			}
+		}
+
+		for _, key := range keys {
+			auth, ok := config.Auths[key]
+			if !ok {
+				continue
+			}
+			if auth.Username != "" {
+				return &registryCredentials{auth.Username, auth.Password}, nil
+			}
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, err)
+			}
+			username, password, _ := strings.Cut(string(decoded), ":")
+			return &registryCredentials{username, password}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// challengeParams parses the parameters of a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func challengeParams(header string) (string, map[string]string) {
+
+	scheme, rest, _ := strings.Cut(header, " ")
+	params := make(map[string]string)
+
+	for _, part := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+
+	return strings.ToLower(scheme), params
+}
+
+// registryUnavailable marks registry errors that are not caused by the
+// request: the registry could not be reached or failed to answer.
+type registryUnavailable struct {
+	err error
+}
+
+func (unavailable *registryUnavailable) Error() string {
+	return unavailable.err.Error()
+}
+
+func (unavailable *registryUnavailable) Unwrap() error {
+	return unavailable.err
+}
+
+// registryStatus wraps the error of a failed registry response, marking
+// server errors and rate limits as the registry being unavailable.
+func registryStatus(response *http.Response, err error) error {
+	if response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests {
+		return &registryUnavailable{err}
+	}
+	return err
+}
+
+// bearerToken fetches a pull token for the repository from the token
+// endpoint named in a Bearer challenge.
+func bearerToken(
+	ctx context.Context, client *http.Client, params map[string]string, repository string,
+	credentials *registryCredentials,
+) (string, error) {
+
+	query := url.Values{}
+	query.Set("scope", "repository:"+repository+":pull")
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if credentials != nil {
+		request.SetBasicAuth(credentials.username, credentials.password)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", &registryUnavailable{err}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", registryStatus(response, fmt.Errorf("token request to %s failed: %s", params["realm"], response.Status))
+	}
+
+	token := struct {
+		Token        string `json:"token"`
+		Access_token string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", &registryUnavailable{err}
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	return token.Access_token, nil
+}
+
+// resolveDigest asks the registry for the digest of a tag with a manifest
+// HEAD request, answering a Bearer or Basic auth challenge once.
+func resolveDigest(
+	ctx context.Context, reference *imageReference, credentials *registryCredentials, insecure bool,
+) (string, error) {
+
+	client := &http.Client{Timeout: registryTimeout}
+
+	host := reference.registry
+	if host == dockerHubRegistry {
+		host = dockerHubHost
+	}
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, reference.repository, reference.tag)
+
+	head := func(authorization string) (*http.Response, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, &registryUnavailable{err}
+		}
+		response.Body.Close()
+		return response, nil
+	}
+
+	response, err := head("")
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		scheme, params := challengeParams(response.Header.Get("WWW-Authenticate"))
+		authorization := ""
+		switch {
+		case scheme == "bearer":
+			token, err := bearerToken(ctx, client, params, reference.repository, credentials)
+			if err != nil {
+				return "", err
+			}
+			authorization = "Bearer " + token
+		case scheme == "basic" && credentials != nil:
+			authorization = "Basic " + base64.StdEncoding.EncodeToString(
+				[]byte(credentials.username+":"+credentials.password),
+			)
+		default:
+			return "", fmt.Errorf("registry %s requires credentials, add an image pull secret", reference.registry)
+		}
+
+		response, err = head(authorization)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return "", registryStatus(response, fmt.Errorf("manifest %s: %s", manifestURL, response.Status))
+	}
+
+	digest := response.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", &registryUnavailable{
+			fmt.Errorf("registry %s returned no digest for %s", reference.registry, reference.tag),
+		}
+	}
+
+	return digest, nil
+}
+
+// ResolveImage fills in the default image from the config and checks the
+// pull policy. With resolve_digest it pins the image to the digest the tag
+// currently points at, so every pod of the deployment runs the same image.
+func (config *ServerConfig) ResolveImage(ctx context.Context, clients *Clients, model *ModelDeploy) error {
+
+	if model.Image == "" {
+		model.Image = config.Default_image
+	}
+	if model.Image == "" {
+		return fieldError("image", "is required, no default image is configured")
+	}
+
+	switch apiv1.PullPolicy(model.Image_pull_policy) {
+	case "", apiv1.PullAlways, apiv1.PullIfNotPresent, apiv1.PullNever:
+	default:
+		return fieldError("image_pull_policy", fmt.Sprintf(
+			"unknown pull policy %q, use Always, IfNotPresent or Never", model.Image_pull_policy,
+		))
+	}
+
+	model.Image_pull_secrets = append(model.Image_pull_secrets, config.Image_pull_secrets...)
+
+	reference, err := parseImage(model.Image)
+	if err != nil {
+		return fieldError("image", err.Error())
+	}
+	if reference.digest != "" {
+		model.imageDigest = reference.digest
+		return nil
+	}
+	if !model.Resolve_digest {
+		return nil
+	}
+
+	credentials, err := pullCredentials(ctx, clients, model.Image_pull_secrets, reference.registry)
+	if err != nil {
+		return err
+	}
+
+	insecure := false
+	for _, registry := range config.Insecure_registries {
+		if registry == reference.registry {
+			insecure = true
+		}
+	}
+
+	// A missing tag or denied access is the request's fault, a registry that
+	// cannot be reached is not.
+	digest, err := resolveDigest(ctx, reference, credentials, insecure)
+	unavailable := new(registryUnavailable)
+	if errors.As(err, &unavailable) {
+		return NewAPIError(ErrorUnavailable, fmt.Sprintf("resolving the digest of %s: %s", model.Image, err))
+	}
+	if err != nil {
+		return fieldError("image", fmt.Sprintf("resolving the digest of %s: %s", model.Image, err))
+	}
+
+	fmt.Printf("Resolved image %s to %s.\n", model.Image, digest)
+
+	model.Image = model.Image + "@" + digest
+	model.imageDigest = digest
+
+	return nil
+}
+
+// pullPolicy defaults to IfNotPresent for images pinned to a digest, which
+// cannot change, and to Always for tags.
+func (model *ModelDeploy) pullPolicy() apiv1.PullPolicy {
+	if model.Image_pull_policy != "" {
+		return apiv1.PullPolicy(model.Image_pull_policy)
+	}
+	if model.imageDigest != "" {
+		return apiv1.PullIfNotPresent
+	}
+	return apiv1.PullAlways
+}
+
+func (model *ModelDeploy) pullSecrets() []apiv1.LocalObjectReference {
+
+	seen := make(map[string]bool)
+	secrets := make([]apiv1.LocalObjectReference, 0)
+	for _, name := range model.Image_pull_secrets {
+		if !seen[name] {
+			seen[name] = true
+			secrets = append(secrets, apiv1.LocalObjectReference{Name: name})
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	return secrets
+}
+
+// imageAnnotations record the deployed image on the Deployment. The change
+// cause is copied to the ReplicaSet and shows up in the rollout history.
+func (model *ModelDeploy) imageAnnotations() map[string]string {
+
+	annotations := map[string]string{
+		changeCauseAnnotation: "deploy " + model.Image,
+	}
+	if model.imageDigest != "" {
+		annotations[imageDigestAnnotation] = model.imageDigest
+	}
+
+	return annotations
+}
@@ -0,0 +1,500 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	AutoscalerHpa  = "hpa"
+	AutoscalerKeda = "keda"
+
+	// kedaHpaPrefix names the HPA KEDA creates for a ScaledObject.
+	kedaHpaPrefix = "keda-hpa-"
+
+	// defaultRequestQuery is the request rate of the ingress of a version,
+	// as exported by ingress-nginx.
+	defaultRequestQuery = `sum(rate(nginx_ingress_controller_requests{namespace="%s",ingress="%s"}[2m]))`
+)
+
+var scaledObjectResource = schema.GroupVersionResource{
+	Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects",
+}
+
+// Keda scales a model with a KEDA ScaledObject instead of an HPA, which
+// allows min_replicas 0. Prometheus scales on a query, the request rate of
+// the endpoint by default, and Queue on the length of a queue through any
+// KEDA scaler, such as rabbitmq, aws-sqs-queue or redis.
+type Keda struct {
+	Polling_interval *int32             `json:"polling_interval"`
+	Cooldown_period  *int32             `json:"cooldown_period"`
+	Prometheus       *PrometheusTrigger `json:"prometheus"`
+	Queue            *QueueTrigger      `json:"queue"`
+}
+
+// PrometheusTrigger adds a replica for every Threshold of the query result.
+// Activation_threshold is the value above which an endpoint scaled to zero
+// is woken up.
+type PrometheusTrigger struct {
+	Server_address       string `json:"server_address"`
+	Query                string `json:"query"`
+	Threshold            string `json:"threshold"`
+	Activation_threshold string `json:"activation_threshold"`
+}
+
+// QueueTrigger passes Metadata to the KEDA scaler named by Type. Credentials
+// come from the TriggerAuthentication named by Authentication_ref.
+type QueueTrigger struct {
+	Type               string            `json:"type"`
+	Metadata           map[string]string `json:"metadata"`
+	Authentication_ref string            `json:"authentication_ref"`
+}
+
+func (model *ModelDeploy) kedaScaling() bool {
+	return model.Autoscaling != nil && !model.Autoscaling.Disabled && model.Autoscaling.Mode == AutoscalerKeda
+}
+
+// usesHpa reports whether the model is scaled by an HPA of its own.
+func (model *ModelDeploy) usesHpa() bool {
+	return !model.autoscalingDisabled() && !model.kedaScaling()
+}
+
+func (model *ModelDeploy) autoscalerKind() string {
+	if model.kedaScaling() {
+		return "ScaledObject"
+	}
+	return "HorizontalPodAutoscaler"
+}
+
+func validThreshold(value string) bool {
+	parsed, err := strconv.ParseFloat(value, 64)
+	return err == nil && parsed > 0
+}
+
+// validateKeda checks the KEDA triggers of a model and fills in the
+// Prometheus server from the config.
+func (config *ServerConfig) validateKeda(autoscaling *Autoscaling) []*APIError {
+
+	invalid := make([]*APIError, 0)
+
+	if autoscaling.Cpu_utilization != nil || autoscaling.Memory_utilization != nil || len(autoscaling.Metrics) > 0 {
+		invalid = append(invalid, fieldError("autoscaling.mode", "keda scales on its triggers, not on utilization or metrics"))
+	}
+
+	keda := autoscaling.Keda
+	if keda == nil || (keda.Prometheus == nil && keda.Queue == nil) {
+		return append(invalid, fieldError("autoscaling.keda", "set a prometheus or queue trigger"))
+	}
+
+	if keda.Polling_interval != nil && *keda.Polling_interval < 1 {
+		invalid = append(invalid, fieldError("autoscaling.keda.polling_interval", "must be at least 1"))
+	}
+	if keda.Cooldown_period != nil && *keda.Cooldown_period < 0 {
+		invalid = append(invalid, fieldError("autoscaling.keda.cooldown_period", "must not be negative"))
+	}
+
+	if prometheus := keda.Prometheus; prometheus != nil {
+		if prometheus.Server_address == "" {
+			prometheus.Server_address = config.Prometheus_address
+		}
+		if prometheus.Server_address == "" {
+			invalid = append(invalid, fieldError("autoscaling.keda.prometheus.server_address", "is required, no prometheus_address is configured"))
+		}
+		if !validThreshold(prometheus.Threshold) {
+			invalid = append(invalid, fieldError("autoscaling.keda.prometheus.threshold", fmt.Sprintf(
+				"%q is not a number above 0", prometheus.Threshold,
+			)))
+		}
+		if prometheus.Activation_threshold != "" && !validThreshold(prometheus.Activation_threshold) {
+			invalid = append(invalid, fieldError("autoscaling.keda.prometheus.activation_threshold", fmt.Sprintf(
+				"%q is not a number above 0", prometheus.Activation_threshold,
+			)))
+		}
+	}
+
+	if queue := keda.Queue; queue != nil {
+		if queue.Type == "" {
+			invalid = append(invalid, fieldError("autoscaling.keda.queue.type", "is required, for example rabbitmq or aws-sqs-queue"))
+		}
+		if len(queue.Metadata) == 0 {
+			invalid = append(invalid, fieldError("autoscaling.keda.queue.metadata", "is required"))
+		}
+	}
+
+	return invalid
+}
+
+func (model *ModelDeploy) kedaTriggers(name string) []interface{} {
+
+	keda := model.Autoscaling.Keda
+	triggers := make([]interface{}, 0, 2)
+
+	if prometheus := keda.Prometheus; prometheus != nil {
+		query := prometheus.Query
+		if query == "" {
+			query = fmt.Sprintf(defaultRequestQuery, model.Namespace, name)
+		}
+		metadata := map[string]interface{}{
+			"serverAddress": prometheus.Server_address,
+			"query":         query,
+			"threshold":     prometheus.Threshold,
+		}
+		if prometheus.Activation_threshold != "" {
+			metadata["activationThreshold"] = prometheus.Activation_threshold
+		}
+		triggers = append(triggers, map[string]interface{}{
+			"type":     "prometheus",
+			"metadata": metadata,
+		})
+	}
+
+	if queue := keda.Queue; queue != nil {
+		metadata := make(map[string]interface{}, len(queue.Metadata))
+		for key, value := range queue.Metadata {
+			metadata[key] = value
+		}
+		trigger := map[string]interface{}{
+			"type":     queue.Type,
+			"metadata": metadata,
+		}
+		if queue.Authentication_ref != "" {
+			trigger["authenticationRef"] = map[string]interface{}{"name": queue.Authentication_ref}
+		}
+		triggers = append(triggers, trigger)
+	}
+
+	return triggers
+}
+
+func newScaledObject(model *ModelDeploy, endpoint string) *unstructured.Unstructured {
+
+	canary_version := model.canaryVersion()
+	name := endpoint + canary_version
+
+	minReplicas, maxReplicas := model.Autoscaling.bounds()
+	annotations := model.weightAnnotations(minReplicas, maxReplicas)
+	minReplicas, maxReplicas = model.weightedBounds(minReplicas, maxReplicas)
+
+	spec := map[string]interface{}{
+		"scaleTargetRef": map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"name":       name,
+		},
+		"minReplicaCount": int64(minReplicas),
+		"maxReplicaCount": int64(maxReplicas),
+		"triggers":        model.kedaTriggers(name),
+	}
+
+	keda := model.Autoscaling.Keda
+	if keda.Polling_interval != nil {
+		spec["pollingInterval"] = int64(*keda.Polling_interval)
+	}
+	if keda.Cooldown_period != nil {
+		spec["cooldownPeriod"] = int64(*keda.Cooldown_period)
+	}
+	if behavior := model.Autoscaling.Behavior; behavior != nil {
+		// Validated by the API server, which takes the same structure.
+		converted, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(behavior)
+		spec["advanced"] = map[string]interface{}{
+			"horizontalPodAutoscalerConfig": map[string]interface{}{"behavior": converted},
+		}
+	}
+
+	scaledObject := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "keda.sh/v1alpha1",
+		"kind":       "ScaledObject",
+		"spec":       spec,
+	}}
+	scaledObject.SetName(name)
+	scaledObject.SetNamespace(model.Namespace)
+	scaledObject.SetLabels(managedLabels(endpoint, canary_version))
+	if annotations != nil {
+		scaledObject.SetAnnotations(annotations)
+	}
+
+	return scaledObject
+}
+
+// appliedScaledObject keeps the parts of a ScaledObject this server applies,
+// so it can be applied again as it is.
+func appliedScaledObject(scaledObject *unstructured.Unstructured) *unstructured.Unstructured {
+
+	applied := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	applied.SetAPIVersion(scaledObject.GetAPIVersion())
+	applied.SetKind(scaledObject.GetKind())
+	applied.SetName(scaledObject.GetName())
+	applied.SetNamespace(scaledObject.GetNamespace())
+	applied.SetLabels(scaledObject.GetLabels())
+	applied.SetAnnotations(scaledObject.GetAnnotations())
+	if spec, ok := scaledObject.Object["spec"]; ok {
+		applied.Object["spec"] = spec
+	}
+
+	return applied
+}
+
+func patchScaledObject(
+	scaledObjects dynamic.ResourceInterface, name string,
+) func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+	return func(ctx context.Context, data []byte, options metav1.PatchOptions) error {
+		_, err := scaledObjects.Patch(ctx, name, types.ApplyPatchType, data, options)
+		if apierrors.IsNotFound(err) {
+			return fmt.Errorf("applying ScaledObject %s, is KEDA installed? %w", name, err)
+		}
+		return err
+	}
+}
+
+func restoreScaledObject(
+	ctx context.Context, scaledObjects dynamic.ResourceInterface, previous *unstructured.Unstructured,
+) error {
+	force := true
+	data, err := appliedScaledObject(previous).MarshalJSON()
+	if err != nil {
+		return err
+	}
+	_, err = scaledObjects.Patch(ctx, previous.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager, Force: &force,
+	})
+	return err
+}
+
+func CrudScaledObject(
+	ctx context.Context,
+	scaledObjects dynamic.ResourceInterface,
+	model *ModelDeploy,
+	endpoint string,
+	tx *DeployTransaction,
+) error {
+
+	scaledObject := newScaledObject(model, endpoint)
+	name := scaledObject.GetName()
+
+	existing, getErr := scaledObjects.Get(ctx, name, metav1.GetOptions{})
+	if getErr != nil && !apierrors.IsNotFound(getErr) {
+		return getErr
+	}
+
+	fmt.Println("Applying scaled object...")
+	applyErr := applyObject(ctx, "ScaledObject", name, scaledObject, model, patchScaledObject(scaledObjects, name))
+	if applyErr != nil {
+		return applyErr
+	}
+	fmt.Printf("Applied scaled object %q.\n", name)
+
+	if getErr != nil {
+		tx.recordCreate("ScaledObject", name, func(ctx context.Context) error {
+			return scaledObjects.Delete(ctx, name, metav1.DeleteOptions{})
+		})
+	} else {
+		tx.recordUpdate("ScaledObject", name, func(ctx context.Context) error {
+			return restoreScaledObject(ctx, scaledObjects, existing)
+		})
+	}
+
+	return nil
+}
+
+// removeScaledObject deletes the ScaledObject of a model that is no longer
+// scaled by KEDA. Clusters without KEDA have none.
+func removeScaledObject(
+	ctx context.Context,
+	scaledObjects dynamic.ResourceInterface,
+	model *ModelDeploy,
+	name string,
+	tx *DeployTransaction,
+) error {
+
+	existing, err := scaledObjects.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Deleting scaled object...")
+	if err := scaledObjects.Delete(ctx, name, metav1.DeleteOptions{DryRun: model.dryRun()}); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted scaled object %q.\n", name)
+
+	tx.recordUpdate("ScaledObject", name, func(ctx context.Context) error {
+		return restoreScaledObject(ctx, scaledObjects, existing)
+	})
+
+	return nil
+}
+
+// CrudAutoscaler scales the model the way its request asks for, with an HPA,
+// a KEDA ScaledObject or a fixed replica count, and removes whichever of the
+// other two it had before.
+func CrudAutoscaler(
+	ctx context.Context,
+	clients *Clients,
+	model *ModelDeploy,
+	endpoint string,
+	tx *DeployTransaction,
+) error {
+
+	// Whichever autoscaler is left goes first, so two HPAs never scale the
+	// deployment at once: KEDA refuses to scale a deployment another HPA
+	// scales, and the HPA KEDA made goes away with its ScaledObject.
+	if model.kedaScaling() {
+		if err := CrudHpa(ctx, clients.Hpas, model, endpoint, tx); err != nil {
+			return err
+		}
+		return CrudScaledObject(ctx, clients.ScaledObjects, model, endpoint, tx)
+	}
+
+	if err := removeScaledObject(ctx, clients.ScaledObjects, model, endpoint+model.canaryVersion(), tx); err != nil {
+		return err
+	}
+
+	return CrudHpa(ctx, clients.Hpas, model, endpoint, tx)
+}
+
+func scaledObjectTarget(scaledObject *unstructured.Unstructured) string {
+	target, _, _ := unstructured.NestedString(scaledObject.Object, "spec", "scaleTargetRef", "name")
+	return target
+}
+
+// transitionTriggers points default request rate queries of a promoted
+// canary at the stable Ingress of the endpoint, as /transition deletes the
+// Ingress of the canary. It reports whether a query changed.
+func transitionTriggers(applied *unstructured.Unstructured, endpoint, toDestroy string) (bool, error) {
+
+	triggers, found, err := unstructured.NestedSlice(applied.Object, "spec", "triggers")
+	if err != nil || !found {
+		return false, err
+	}
+
+	canaryQuery := fmt.Sprintf(defaultRequestQuery, applied.GetNamespace(), toDestroy)
+	changed := false
+	for _, trigger := range triggers {
+		trigger, ok := trigger.(map[string]interface{})
+		if !ok || trigger["type"] != "prometheus" {
+			continue
+		}
+		metadata, ok := trigger["metadata"].(map[string]interface{})
+		if ok && metadata["query"] == canaryQuery {
+			metadata["query"] = fmt.Sprintf(defaultRequestQuery, applied.GetNamespace(), endpoint)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	return true, unstructured.SetNestedSlice(applied.Object, triggers, "spec", "triggers")
+}
+
+// transitionScaledObjectApply is transitionHpaApply for a canary scaled by
+// KEDA, which also moves default request rate queries to the stable Ingress.
+// It returns nil when nothing changes.
+func transitionScaledObjectApply(
+	scaledObject *unstructured.Unstructured, endpoint, toDestroy string,
+) (*unstructured.Unstructured, error) {
+
+	applied := appliedScaledObject(scaledObject.DeepCopy())
+
+	changed, err := transitionTriggers(applied, endpoint, toDestroy)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := applied.GetAnnotations()
+	minValue, hasMin := annotations[minReplicasAnnotation]
+	maxValue, hasMax := annotations[maxReplicasAnnotation]
+	if !hasMin || !hasMax {
+		if !changed {
+			return nil, nil
+		}
+		return applied, nil
+	}
+
+	minReplicas, err := strconv.ParseInt(minValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %w", minReplicasAnnotation, err)
+	}
+	maxReplicas, err := strconv.ParseInt(maxValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %w", maxReplicasAnnotation, err)
+	}
+
+	delete(annotations, minReplicasAnnotation)
+	delete(annotations, maxReplicasAnnotation)
+	applied.SetAnnotations(annotations)
+	if err := unstructured.SetNestedField(applied.Object, minReplicas, "spec", "minReplicaCount"); err != nil {
+		return nil, err
+	}
+	if err := unstructured.SetNestedField(applied.Object, maxReplicas, "spec", "maxReplicaCount"); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// TransitionScaledObject scales the ScaledObject of a promoted canary up to
+// the bounds it has at full traffic and moves its default query to the
+// stable Ingress.
+func TransitionScaledObject(
+	ctx context.Context, scaledObjects dynamic.ResourceInterface, endpoint, toDestroy string,
+) error {
+
+	scaledObject, getErr := scaledObjects.Get(ctx, toDestroy, metav1.GetOptions{})
+	if apierrors.IsNotFound(getErr) {
+		return nil
+	}
+	if getErr != nil {
+		return ResourceError("ScaledObject", toDestroy, getErr)
+	}
+
+	applied, err := transitionScaledObjectApply(scaledObject, endpoint, toDestroy)
+	if err != nil {
+		return ResourceError("ScaledObject", toDestroy, err)
+	}
+	if applied == nil {
+		return nil
+	}
+
+	fmt.Println("Applying scaled object...")
+	if err := restoreScaledObject(ctx, scaledObjects, applied); err != nil {
+		return ResourceError("ScaledObject", toDestroy, err)
+	}
+	fmt.Printf("Applied scaled object %q.\n", toDestroy)
+
+	return nil
+}
+
+// DeleteScaledObject is DeleteHpa for ScaledObjects. Nothing is deleted on
+// clusters without KEDA.
+func DeleteScaledObject(scaledObjects dynamic.ResourceInterface, name, target string, deleteChannel chan error) {
+	fmt.Println("Deleting scaled object...")
+	scaledObject, err := scaledObjects.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) || (err == nil && scaledObjectTarget(scaledObject) != target) {
+		fmt.Println("No scaled object to delete.")
+		deleteChannel <- nil
+		return
+	}
+	if err != nil {
+		deleteChannel <- ResourceError("ScaledObject", name, err)
+		return
+	}
+	if err := scaledObjects.Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		deleteChannel <- ResourceError("ScaledObject", name, err)
+		return
+	}
+	fmt.Println("Deleted scaled object.")
+	deleteChannel <- nil
+}
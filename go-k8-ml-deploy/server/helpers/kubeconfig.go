@@ -0,0 +1,119 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	authenticationv1beta1 "k8s.io/api/authentication/v1beta1"
+)
+
+type ClusterInfo struct {
+	Source    string
+	Context   string
+	Host      string
+	Namespace string
+}
+
+// NewKubeConfig uses the in-cluster service account unless a kubeconfig or
+// context was asked for explicitly, and falls back to the usual kubeconfig
+// loading rules (KUBECONFIG, ~/.kube/config) when not running in a cluster.
+func NewKubeConfig(config *ServerConfig) (*rest.Config, *ClusterInfo, error) {
+
+	explicit := config.Kubeconfig != "" || config.Context != "" || os.Getenv("KUBECONFIG") != ""
+
+	var restConfig *rest.Config
+	info := &ClusterInfo{}
+
+	if !explicit {
+		inCluster, err := rest.InClusterConfig()
+		if err == nil {
+			restConfig = inCluster
+			info.Source = "in-cluster"
+			info.Namespace = "default"
+			if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+				if namespace := strings.TrimSpace(string(data)); namespace != "" {
+					info.Namespace = namespace
+				}
+			}
+		} else {
+			fmt.Printf("In-cluster config unavailable (%s), falling back to kubeconfig.\n", err)
+		}
+	}
+
+	if restConfig == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = config.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: config.Context}
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+		kubeConfig, err := clientConfig.ClientConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		restConfig = kubeConfig
+
+		rawConfig, err := clientConfig.RawConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		info.Source = "kubeconfig"
+		info.Context = rawConfig.CurrentContext
+		if config.Context != "" {
+			info.Context = config.Context
+		}
+
+		namespace, _, err := clientConfig.Namespace()
+		if err != nil {
+			return nil, nil, err
+		}
+		info.Namespace = namespace
+	}
+
+	if config.Qps > 0 {
+		restConfig.QPS = config.Qps
+	}
+	if config.Burst > 0 {
+		restConfig.Burst = config.Burst
+	}
+
+	info.Host = restConfig.Host
+
+	return restConfig, info, nil
+}
+
+// LogClusterIdentity prints which cluster the server connected to and the
+// identity it acts as. Clusters without the SelfSubjectReview API only get the
+// server address and version logged.
+func LogClusterIdentity(clientset kubernetes.Interface, info *ClusterInfo) {
+
+	version := "unknown"
+	if serverVersion, err := clientset.Discovery().ServerVersion(); err == nil {
+		version = serverVersion.GitVersion
+	} else {
+		fmt.Printf("Could not read server version: %s\n", err)
+	}
+
+	identity := "unknown"
+	review, err := clientset.AuthenticationV1beta1().SelfSubjectReviews().Create(
+		context.TODO(), &authenticationv1beta1.SelfSubjectReview{}, metav1.CreateOptions{},
+	)
+	if err == nil {
+		identity = review.Status.UserInfo.Username
+	}
+
+	if info.Context != "" {
+		fmt.Printf(
+			"Connected to %s (%s, context %q, %s) as %s.\n",
+			info.Host, info.Source, info.Context, version, identity,
+		)
+	} else {
+		fmt.Printf("Connected to %s (%s, %s) as %s.\n", info.Host, info.Source, version, identity)
+	}
+}
@@ -0,0 +1,219 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	OperationPending   = "Pending"
+	OperationRunning   = "Running"
+	OperationSucceeded = "Succeeded"
+	OperationFailed    = "Failed"
+
+	// operationRetention is how long finished operations stay queryable.
+	operationRetention = time.Hour
+)
+
+var ErrQueueFull = errors.New("operation queue is full")
+
+type ResourceProgress struct {
+	Kind  string
+	Name  string
+	State string
+	Error string
+}
+
+type Operation struct {
+	Id        string
+	Type      string
+	Endpoint  string
+	Namespace string
+	State     string
+	Created   time.Time
+	Started   *time.Time
+	Finished  *time.Time
+	Resources []ResourceProgress
+	Result    interface{}
+	Error     *APIError `json:",omitempty"`
+}
+
+type OperationReturn struct {
+	Operation_id string
+	State        string
+	Status_url   string
+}
+
+// OperationFunc does the work of an operation. Its result is stored on the
+// operation when it returns without error.
+type OperationFunc func(ctx context.Context, progress ProgressFunc) (interface{}, error)
+
+type queuedOperation struct {
+	id  string
+	run OperationFunc
+}
+
+// OperationManager runs operations on a bounded pool of workers and keeps
+// their progress in memory for polling.
+type OperationManager struct {
+	mu         sync.Mutex
+	operations map[string]*Operation
+	queue      chan queuedOperation
+	timeout    time.Duration
+}
+
+func NewOperationManager(workers, queueSize int, timeout time.Duration) *OperationManager {
+
+	manager := &OperationManager{
+		operations: make(map[string]*Operation),
+		queue:      make(chan queuedOperation, queueSize),
+		timeout:    timeout,
+	}
+
+	for i := 0; i < workers; i++ {
+		go manager.worker()
+	}
+
+	return manager
+}
+
+func (manager *OperationManager) worker() {
+	for queued := range manager.queue {
+		manager.execute(queued)
+	}
+}
+
+func (manager *OperationManager) execute(queued queuedOperation) {
+
+	manager.update(queued.id, func(operation *Operation) {
+		now := time.Now()
+		operation.Started = &now
+		operation.State = OperationRunning
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), manager.timeout)
+	defer cancel()
+
+	progress := func(kind, name, state string, err error) {
+		manager.update(queued.id, func(operation *Operation) {
+			message := ""
+			if err != nil {
+				message = err.Error()
+			}
+			for i := range operation.Resources {
+				if operation.Resources[i].Kind == kind && operation.Resources[i].Name == name {
+					operation.Resources[i].State = state
+					operation.Resources[i].Error = message
+					return
+				}
+			}
+			operation.Resources = append(operation.Resources, ResourceProgress{
+				Kind: kind, Name: name, State: state, Error: message,
+			})
+		})
+	}
+
+	result, err := queued.run(ctx, progress)
+
+	manager.update(queued.id, func(operation *Operation) {
+		now := time.Now()
+		operation.Finished = &now
+		if err != nil {
+			operation.State = OperationFailed
+			operation.Error = ClassifyError(err)
+			return
+		}
+		operation.State = OperationSucceeded
+		operation.Result = result
+	})
+
+	fmt.Printf("Finished operation %s.\n", queued.id)
+}
+
+func (manager *OperationManager) update(id string, change func(operation *Operation)) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if operation, ok := manager.operations[id]; ok {
+		change(operation)
+	}
+}
+
+func (manager *OperationManager) prune() {
+	cutoff := time.Now().Add(-operationRetention)
+	for id, operation := range manager.operations {
+		if operation.Finished != nil && operation.Finished.Before(cutoff) {
+			delete(manager.operations, id)
+		}
+	}
+}
+
+// Submit queues run and returns the new operation. It fails with ErrQueueFull
+// instead of blocking when every worker is busy and the queue is at capacity.
+func (manager *OperationManager) Submit(operation Operation, run OperationFunc) (Operation, error) {
+
+	operation.Id = uuid.NewString()
+	operation.State = OperationPending
+	operation.Created = time.Now()
+
+	stored := operation
+	stored.Resources = append([]ResourceProgress(nil), operation.Resources...)
+
+	manager.mu.Lock()
+	manager.prune()
+	manager.operations[operation.Id] = &stored
+	manager.mu.Unlock()
+
+	select {
+	case manager.queue <- queuedOperation{id: operation.Id, run: run}:
+		fmt.Printf("Queued operation %s.\n", operation.Id)
+		return operation, nil
+	default:
+		manager.mu.Lock()
+		delete(manager.operations, operation.Id)
+		manager.mu.Unlock()
+		return Operation{}, ErrQueueFull
+	}
+}
+
+// Get returns a copy of the operation so callers can read it without holding
+// the manager lock.
+func (manager *OperationManager) Get(id string) (Operation, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	operation, ok := manager.operations[id]
+	if !ok {
+		return Operation{}, false
+	}
+
+	snapshot := *operation
+	snapshot.Resources = append([]ResourceProgress(nil), operation.Resources...)
+
+	return snapshot, true
+}
+
+func CreateOperationResponse(operation Operation) ([]byte, error) {
+
+	message := new(OperationReturn)
+	message.Operation_id = operation.Id
+	message.State = operation.State
+	message.Status_url = "/operations/" + operation.Id
+
+	message_parsed, error := json.Marshal(message)
+
+	return message_parsed, error
+}
+
+func CreateOperationStatusResponse(operation Operation) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(operation)
+
+	return message_parsed, error
+}
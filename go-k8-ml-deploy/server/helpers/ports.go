@@ -0,0 +1,198 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const defaultInferencePort = 8080
+
+// Port is a container port of the model server. The Service and Ingress of
+// the endpoint route to the port marked Inference; the others are exposed on
+// the Service as well so they can be scraped. Service_port defaults to
+// Container_port and Protocol to TCP. Metrics marks the port Prometheus should
+// scrape.
+type Port struct {
+	Name           string `json:"name"`
+	Container_port int32  `json:"container_port"`
+	Service_port   *int32 `json:"service_port"`
+	Protocol       string `json:"protocol"`
+	Inference      bool   `json:"inference"`
+	Metrics        bool   `json:"metrics"`
+}
+
+func (port Port) servicePort() int32 {
+	if port.Service_port != nil {
+		return *port.Service_port
+	}
+	return port.Container_port
+}
+
+func (port Port) protocol() apiv1.Protocol {
+	if port.Protocol == "" {
+		return apiv1.ProtocolTCP
+	}
+	return apiv1.Protocol(port.Protocol)
+}
+
+// modelPorts returns the ports of the model with the inference port first.
+// Without ports the model serves on 8080 only, and with a single port that
+// port serves inference.
+func (model *ModelDeploy) modelPorts() []Port {
+
+	if len(model.Ports) == 0 {
+		return []Port{{Container_port: defaultInferencePort, Inference: true}}
+	}
+
+	ports := make([]Port, 0, len(model.Ports))
+	for _, port := range model.Ports {
+		if port.Inference || len(model.Ports) == 1 {
+			port.Inference = true
+			ports = append([]Port{port}, ports...)
+		} else {
+			ports = append(ports, port)
+		}
+	}
+
+	return ports
+}
+
+func (model *ModelDeploy) inferencePort() Port {
+	return model.modelPorts()[0]
+}
+
+// ValidatePorts requires exactly one TCP inference port when several ports
+// are given, and names on every other port so the Service can refer to them.
+// The inference port is named after the deployment, which has to make a
+// valid port name of at most 15 characters.
+func (model *ModelDeploy) ValidatePorts(endpoint string) error {
+
+	invalid := make([]*APIError, 0)
+
+	name := endpoint
+	if model.Canary_version != nil {
+		name += *model.Canary_version
+	}
+	if errs := validation.IsValidPortName(name); len(errs) > 0 {
+		invalid = append(invalid, fieldError("canary_version", fmt.Sprintf(
+			"the inference port is named %q after the deployment: %s", name, errs[0],
+		)))
+	}
+
+	inference := 0
+	names := make(map[string]bool)
+	servicePorts := make(map[string]bool)
+
+	for i, port := range model.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+
+		if port.Container_port < 1 || port.Container_port > 65535 {
+			invalid = append(invalid, fieldError(field+".container_port", "must be between 1 and 65535"))
+		}
+		if port.servicePort() < 1 || port.servicePort() > 65535 {
+			invalid = append(invalid, fieldError(field+".service_port", "must be between 1 and 65535"))
+		}
+
+		switch port.protocol() {
+		case apiv1.ProtocolTCP, apiv1.ProtocolUDP, apiv1.ProtocolSCTP:
+		default:
+			invalid = append(invalid, fieldError(field+".protocol", fmt.Sprintf(
+				"unknown protocol %q, use TCP, UDP or SCTP", port.Protocol,
+			)))
+		}
+
+		key := strconv.Itoa(int(port.servicePort())) + "/" + string(port.protocol())
+		if servicePorts[key] {
+			invalid = append(invalid, fieldError(field+".service_port", fmt.Sprintf("%s is used twice", key)))
+		}
+		servicePorts[key] = true
+
+		if port.Inference || len(model.Ports) == 1 {
+			inference++
+			if port.protocol() != apiv1.ProtocolTCP {
+				invalid = append(invalid, fieldError(field+".protocol", "the inference port must be TCP"))
+			}
+			continue
+		}
+
+		if errs := validation.IsValidPortName(port.Name); len(errs) > 0 {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf("%q: %s", port.Name, errs[0])))
+		}
+		if names[port.Name] {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf("%q is used twice", port.Name)))
+		}
+		names[port.Name] = true
+	}
+
+	if len(model.Ports) > 0 && inference != 1 {
+		invalid = append(invalid, fieldError("ports", "exactly one port must be marked inference"))
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid port fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
+
+// The inference port is named after the deployment, in place of any name it
+// was given, which lets /transition point the stable Service at the canary
+// deployment by port name.
+func (port Port) portName(name string) string {
+	if port.Inference {
+		return name
+	}
+	return port.Name
+}
+
+func (model *ModelDeploy) containerPorts(name string) []apiv1.ContainerPort {
+
+	ports := make([]apiv1.ContainerPort, 0)
+	for _, port := range model.modelPorts() {
+		ports = append(ports, apiv1.ContainerPort{
+			Name:          port.portName(name),
+			ContainerPort: port.Container_port,
+			Protocol:      port.protocol(),
+		})
+	}
+
+	return ports
+}
+
+func (model *ModelDeploy) servicePorts(name string) []apiv1.ServicePort {
+
+	ports := make([]apiv1.ServicePort, 0)
+	for _, port := range model.modelPorts() {
+		ports = append(ports, apiv1.ServicePort{
+			Name:       port.portName(name),
+			Protocol:   port.protocol(),
+			Port:       port.servicePort(),
+			TargetPort: intstr.FromString(port.portName(name)),
+		})
+	}
+
+	return ports
+}
+
+// scrapeAnnotations tells Prometheus which port of the pod to scrape.
+func (model *ModelDeploy) scrapeAnnotations() map[string]string {
+
+	for _, port := range model.modelPorts() {
+		if port.Metrics {
+			return map[string]string{
+				"prometheus.io/scrape": "true",
+				"prometheus.io/port":   strconv.Itoa(int(port.Container_port)),
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidatePorts(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		endpoint string
+		body     string
+		fields   []string
+	}{
+		{"default", "model", `{}`, nil},
+		{"lone named port", "model", `{"ports": [{"name": "http", "container_port": 5000}]}`, nil},
+		{"inference and metrics", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"name": "metrics", "container_port": 9090, "metrics": true}
+		]}`, nil},
+		{"named inference port", "model", `{"ports": [
+			{"name": "http", "container_port": 8080, "inference": true},
+			{"name": "grpc", "container_port": 9000}
+		]}`, nil},
+		{"no inference port", "model", `{"ports": [
+			{"name": "http", "container_port": 8080},
+			{"name": "grpc", "container_port": 9000}
+		]}`, []string{"ports"}},
+		{"two inference ports", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"container_port": 9000, "inference": true}
+		]}`, []string{"ports"}},
+		{"port out of range", "model", `{"ports": [{"container_port": 70000}]}`,
+			[]string{"ports[0].container_port", "ports[0].service_port"}},
+		{"udp inference port", "model", `{"ports": [{"container_port": 8080, "protocol": "UDP"}]}`,
+			[]string{"ports[0].protocol"}},
+		{"unknown protocol", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"name": "quic", "container_port": 9000, "protocol": "QUIC"}
+		]}`, []string{"ports[1].protocol"}},
+		{"duplicate service port", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"name": "admin", "container_port": 9000, "service_port": 8080}
+		]}`, []string{"ports[1].service_port"}},
+		{"unnamed extra port", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"container_port": 9000}
+		]}`, []string{"ports[1].name"}},
+		{"duplicate names", "model", `{"ports": [
+			{"container_port": 8080, "inference": true},
+			{"name": "admin", "container_port": 9000},
+			{"name": "admin", "container_port": 9001}
+		]}`, []string{"ports[2].name"}},
+		{"long deployment name", "fraudscoring", `{"canary_version": "v123"}`, []string{"canary_version"}},
+		{"fifteen character name", "fraudscoring", `{"canary_version": "v1"}`, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := new(ModelDeploy)
+			if err := json.Unmarshal([]byte(test.body), model); err != nil {
+				t.Fatal(err)
+			}
+			checkFields(t, model.ValidatePorts(test.endpoint), test.fields)
+		})
+	}
+}
+
+func TestModelPorts(t *testing.T) {
+
+	model := new(ModelDeploy)
+	body := `{"ports": [
+		{"name": "metrics", "container_port": 9090, "metrics": true},
+		{"name": "http", "container_port": 8080, "service_port": 80, "inference": true}
+	]}`
+	if err := json.Unmarshal([]byte(body), model); err != nil {
+		t.Fatal(err)
+	}
+
+	ports := model.servicePorts("model")
+	if len(ports) != 2 {
+		t.Fatalf("service ports = %d, want 2", len(ports))
+	}
+	if ports[0].Name != "model" || ports[0].Port != 80 || ports[0].TargetPort.StrVal != "model" {
+		t.Errorf("inference port = %+v, want model 80 targeting model", ports[0])
+	}
+	if ports[1].Name != "metrics" || ports[1].Port != 9090 {
+		t.Errorf("metrics port = %+v, want metrics 9090", ports[1])
+	}
+
+	if annotations := model.scrapeAnnotations(); annotations["prometheus.io/port"] != "9090" {
+		t.Errorf("scrape annotations = %v, want port 9090", annotations)
+	}
+}
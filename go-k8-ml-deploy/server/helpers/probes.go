@@ -0,0 +1,99 @@
+package helpers
+
+import (
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const defaultProbePath = "/ping"
+
+// Probe is an HTTP GET probe against the model server, on the inference port
+// unless Port is set. Unset fields take the defaults of the probe kind;
+// Disabled drops the probe entirely.
+type Probe struct {
+	Path                  string `json:"path"`
+	Port                  *int   `json:"port"`
+	Initial_delay_seconds *int32 `json:"initial_delay_seconds"`
+	Period_seconds        *int32 `json:"period_seconds"`
+	Timeout_seconds       *int32 `json:"timeout_seconds"`
+	Success_threshold     *int32 `json:"success_threshold"`
+	Failure_threshold     *int32 `json:"failure_threshold"`
+	Disabled              bool   `json:"disabled"`
+}
+
+type Probes struct {
+	Readiness *Probe `json:"readiness"`
+	Liveness  *Probe `json:"liveness"`
+	Startup   *Probe `json:"startup"`
+}
+
+// The startup probe allows ten minutes for a model to load from the
+// registry. Readiness and liveness only start once it has passed.
+var (
+	defaultReadinessProbe = Probe{Period_seconds: int32Ptr(5), Timeout_seconds: int32Ptr(3), Failure_threshold: int32Ptr(3)}
+	defaultLivenessProbe  = Probe{Period_seconds: int32Ptr(10), Timeout_seconds: int32Ptr(5), Failure_threshold: int32Ptr(3)}
+	defaultStartupProbe   = Probe{Period_seconds: int32Ptr(10), Timeout_seconds: int32Ptr(5), Failure_threshold: int32Ptr(60)}
+)
+
+func int32Ptr(value int32) *int32 {
+	return &value
+}
+
+func int32Or(value, fallback *int32) int32 {
+	if value != nil {
+		return *value
+	}
+	if fallback != nil {
+		return *fallback
+	}
+	return 0
+}
+
+// build turns the probe into a Kubernetes probe, filling unset fields from
+// defaults. A nil probe uses the defaults alone.
+func (probe *Probe) build(defaults Probe, port int) *apiv1.Probe {
+
+	if probe == nil {
+		probe = &Probe{}
+	}
+	if probe.Disabled {
+		return nil
+	}
+
+	path := probe.Path
+	if path == "" {
+		path = defaultProbePath
+	}
+	if probe.Port != nil {
+		port = *probe.Port
+	}
+
+	return &apiv1.Probe{
+		ProbeHandler: apiv1.ProbeHandler{
+			HTTPGet: &apiv1.HTTPGetAction{
+				Path: path,
+				Port: intstr.FromInt(port),
+			},
+		},
+		InitialDelaySeconds: int32Or(probe.Initial_delay_seconds, defaults.Initial_delay_seconds),
+		PeriodSeconds:       int32Or(probe.Period_seconds, defaults.Period_seconds),
+		TimeoutSeconds:      int32Or(probe.Timeout_seconds, defaults.Timeout_seconds),
+		SuccessThreshold:    int32Or(probe.Success_threshold, int32Ptr(1)),
+		FailureThreshold:    int32Or(probe.Failure_threshold, defaults.Failure_threshold),
+	}
+}
+
+// applyProbes sets the readiness, liveness and startup probes of the model
+// container.
+func (model *ModelDeploy) applyProbes(container *apiv1.Container, port int) {
+
+	probes := model.Probes
+	if probes == nil {
+		probes = new(Probes)
+	}
+
+	container.ReadinessProbe = probes.Readiness.build(defaultReadinessProbe, port)
+	container.LivenessProbe = probes.Liveness.build(defaultLivenessProbe, port)
+	container.StartupProbe = probes.Startup.build(defaultStartupProbe, port)
+}
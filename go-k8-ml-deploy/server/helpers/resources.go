@@ -0,0 +1,167 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourceMaximums caps what a single model container may ask for in a
+// namespace. Unset fields are not capped.
+type ResourceMaximums struct {
+	Memory            *resource.Quantity `json:"memory"`
+	Cpu               *resource.Quantity `json:"cpu"`
+	Ephemeral_storage *resource.Quantity `json:"ephemeral_storage"`
+}
+
+// legacyCpu reads a cpu sent as a bare JSON number, which older clients
+// meant as millicores, where a quantity would read it as cores.
+func legacyCpu(data []byte) (*resource.Quantity, error) {
+
+	fields := struct {
+		Cpu json.RawMessage `json:"cpu"`
+	}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	raw := bytes.TrimSpace(fields.Cpu)
+	if len(raw) == 0 || raw[0] == '"' || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	cpu, err := resource.ParseQuantity(string(raw) + "m")
+	if err != nil {
+		return nil, fmt.Errorf("cpu %s is not a number of millicores", raw)
+	}
+
+	return &cpu, nil
+}
+
+func (limits *Limits) UnmarshalJSON(data []byte) error {
+
+	type plain Limits
+	if err := json.Unmarshal(data, (*plain)(limits)); err != nil {
+		return err
+	}
+
+	cpu, err := legacyCpu(data)
+	if err != nil {
+		return err
+	}
+	if cpu != nil {
+		limits.Cpu = cpu
+	}
+
+	return nil
+}
+
+func (requests *Requests) UnmarshalJSON(data []byte) error {
+
+	type plain Requests
+	if err := json.Unmarshal(data, (*plain)(requests)); err != nil {
+		return err
+	}
+
+	cpu, err := legacyCpu(data)
+	if err != nil {
+		return err
+	}
+	if cpu != nil {
+		requests.Cpu = cpu
+	}
+
+	return nil
+}
+
+func wholeMillis(quantity *resource.Quantity) bool {
+	return quantity.Cmp(*resource.NewMilliQuantity(quantity.MilliValue(), resource.DecimalSI)) == 0
+}
+
+type resourceField struct {
+	name    string
+	limit   *resource.Quantity
+	request *resource.Quantity
+	maximum *resource.Quantity
+}
+
+func (config *ServerConfig) maximums(namespace string) ResourceMaximums {
+	if maximums, ok := config.Max_resources[namespace]; ok {
+		return maximums
+	}
+	return config.Max_resources[anyNamespace]
+}
+
+func fieldError(field, message string) *APIError {
+	apiErr := NewAPIError(ErrorInvalid, message)
+	apiErr.Field = field
+	return apiErr
+}
+
+// ValidateResources checks that no quantity is negative, that requests do not
+// exceed limits and that both stay within the maximums configured for the
+// namespace of the model. Every problem is reported as its own field error.
+func (config *ServerConfig) ValidateResources(model *ModelDeploy) error {
+
+	maximums := config.maximums(model.Namespace)
+
+	fields := []resourceField{
+		{"memory", model.Limits.Memory, model.Requests.Memory, maximums.Memory},
+		{"cpu", model.Limits.Cpu, model.Requests.Cpu, maximums.Cpu},
+		{"ephemeral_storage", model.Limits.Ephemeral_storage, model.Requests.Ephemeral_storage, maximums.Ephemeral_storage},
+	}
+
+	invalid := make([]*APIError, 0)
+
+	for _, field := range fields {
+		limitField := "limits." + field.name
+		requestField := "requests." + field.name
+
+		if field.limit != nil && field.limit.Sign() < 0 {
+			invalid = append(invalid, fieldError(limitField, fmt.Sprintf("must not be negative, got %s", field.limit)))
+		}
+		if field.request != nil && field.request.Sign() < 0 {
+			invalid = append(invalid, fieldError(requestField, fmt.Sprintf("must not be negative, got %s", field.request)))
+		}
+
+		if field.name == "cpu" {
+			if field.limit != nil && !wholeMillis(field.limit) {
+				invalid = append(invalid, fieldError(limitField, fmt.Sprintf("%s is not a whole number of millicores", field.limit)))
+			}
+			if field.request != nil && !wholeMillis(field.request) {
+				invalid = append(invalid, fieldError(requestField, fmt.Sprintf("%s is not a whole number of millicores", field.request)))
+			}
+		}
+
+		if field.limit != nil && field.request != nil && field.request.Cmp(*field.limit) > 0 {
+			invalid = append(invalid, fieldError(requestField, fmt.Sprintf(
+				"request %s is greater than limit %s", field.request, field.limit,
+			)))
+		}
+
+		if field.maximum == nil {
+			continue
+		}
+		if field.limit != nil && field.limit.Cmp(*field.maximum) > 0 {
+			invalid = append(invalid, fieldError(limitField, fmt.Sprintf(
+				"limit %s is above the maximum of %s for namespace %s", field.limit, field.maximum, model.Namespace,
+			)))
+		}
+		if field.request != nil && field.request.Cmp(*field.maximum) > 0 {
+			invalid = append(invalid, fieldError(requestField, fmt.Sprintf(
+				"request %s is above the maximum of %s for namespace %s", field.request, field.maximum, model.Namespace,
+			)))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid resource fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
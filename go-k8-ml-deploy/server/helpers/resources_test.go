@@ -0,0 +1,120 @@
+package helpers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestResourceQuantities(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		body    string
+		cpu     string
+		memory  string
+		invalid bool
+	}{
+		{"legacy millicores", `{"cpu": 500, "memory": 1024}`, "500m", "1024", false},
+		{"cpu string in cores", `{"cpu": "2", "memory": "4Gi"}`, "2", "4Gi", false},
+		{"cpu string in millicores", `{"cpu": "250m"}`, "250m", "", false},
+		{"fractional cores", `{"cpu": "0.5"}`, "500m", "", false},
+		{"null", `{"cpu": null}`, "", "", false},
+		{"not a number", `{"cpu": "lots"}`, "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := new(Limits)
+			err := json.Unmarshal([]byte(test.body), limits)
+			if (err != nil) != test.invalid {
+				t.Fatalf("Unmarshal() error = %v, want error %t", err, test.invalid)
+			}
+			if test.invalid {
+				return
+			}
+			for _, quantity := range []struct {
+				got  *resource.Quantity
+				want string
+			}{{limits.Cpu, test.cpu}, {limits.Memory, test.memory}} {
+				if quantity.want == "" {
+					if quantity.got != nil {
+						t.Errorf("got %s, want unset", quantity.got)
+					}
+					continue
+				}
+				if quantity.got == nil || quantity.got.Cmp(resource.MustParse(quantity.want)) != 0 {
+					t.Errorf("got %v, want %s", quantity.got, quantity.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+
+	maximum := resource.MustParse("8Gi")
+	config := &ServerConfig{
+		Max_resources: map[string]ResourceMaximums{anyNamespace: {Memory: &maximum}},
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		fields []string
+	}{
+		{"empty", `{}`, nil},
+		{"within limits", `{"limits": {"cpu": "2", "memory": "4Gi"}, "requests": {"cpu": 500, "memory": "2Gi"}}`, nil},
+		{"negative", `{"limits": {"cpu": "-1"}}`, []string{"limits.cpu"}},
+		{"request above limit", `{"limits": {"memory": "1Gi"}, "requests": {"memory": "2Gi"}}`, []string{"requests.memory"}},
+		{"above maximum", `{"limits": {"memory": "16Gi"}, "requests": {"memory": "10Gi"}}`, []string{"limits.memory", "requests.memory"}},
+		{"sub millicore", `{"requests": {"cpu": "0.0005"}}`, []string{"requests.cpu"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			model := new(ModelDeploy)
+			if err := json.Unmarshal([]byte(test.body), model); err != nil {
+				t.Fatal(err)
+			}
+			checkFields(t, config.ValidateResources(model), test.fields)
+		})
+	}
+}
+
+// checkFields compares the field errors of a validation error with fields,
+// in order. No fields means no error.
+func checkFields(t *testing.T, err error, fields []string) {
+
+	t.Helper()
+
+	if len(fields) == 0 {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return
+	}
+
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("error = %v, want an *APIError", err)
+	}
+
+	got := make([]string, 0)
+	if len(apiErr.Errors) == 0 {
+		got = append(got, apiErr.Field)
+	}
+	for _, fieldErr := range apiErr.Errors {
+		got = append(got, fieldErr.Field)
+	}
+
+	if len(got) != len(fields) {
+		t.Fatalf("fields = %v, want %v", got, fields)
+	}
+	for i := range fields {
+		if got[i] != fields[i] {
+			t.Fatalf("fields = %v, want %v", got, fields)
+		}
+	}
+}
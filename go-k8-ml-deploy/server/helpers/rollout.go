@@ -0,0 +1,133 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultRolloutTimeout = 300
+	rolloutPollInterval   = 2 * time.Second
+)
+
+// RolloutFailure is returned when an endpoint does not become ready. It
+// carries the last observed status so callers can see the pod level reason.
+type RolloutFailure struct {
+	Endpoint          string
+	Deployment        string
+	Service           string
+	Phase             string
+	Reason            string
+	Message           string
+	Deadline_exceeded bool
+	Diagnosis         []Diagnosis
+	Pods              []PodStatus
+}
+
+func (failure *RolloutFailure) Error() string {
+	return fmt.Sprintf("rollout of %s did not complete: %s: %s", failure.Deployment, failure.Reason, failure.Message)
+}
+
+// RolloutTimeout converts a request timeout in seconds, falling back to the
+// default when it is unset.
+func RolloutTimeout(timeout *int) time.Duration {
+	if timeout == nil || *timeout <= 0 {
+		return defaultRolloutTimeout * time.Second
+	}
+	return time.Duration(*timeout) * time.Second
+}
+
+// WaitForRollout blocks until the deployment endpoint+canary_version is
+// Available with every replica updated and serviceName has ready endpoints.
+// It gives up early when the Deployment itself reports that its progress
+// deadline was exceeded, once the controller has observed the applied spec.
+func WaitForRollout(
+	ctx context.Context,
+	clients *Clients,
+	endpoint, canary_version, serviceName string,
+	timeout time.Duration,
+) (*EndpointStatus, error) {
+
+	fmt.Printf("Waiting for rollout of %s...\n", endpoint+canary_version)
+
+	var status *EndpointStatus
+	deadlineExceeded := false
+
+	pollErr := wait.PollUntilContextTimeout(ctx, rolloutPollInterval, timeout, true,
+		func(ctx context.Context) (bool, error) {
+			current, err := GetEndpointStatus(ctx, clients, endpoint, canary_version)
+			if err != nil {
+				return false, err
+			}
+
+			if serviceName != current.Deployment {
+				current.Ready_endpoints, current.Not_ready_endpoints, err = serviceEndpoints(ctx, clients, serviceName)
+				if err != nil {
+					return false, err
+				}
+				current.Service_ready = current.Ready_endpoints > 0
+				current.Healthy = current.Phase == PhaseAvailable && current.Service_ready
+			}
+
+			status = current
+
+			for _, diagnosis := range current.Diagnosis {
+				if diagnosis.Reason == "ProgressDeadlineExceeded" {
+					deadlineExceeded = true
+					return false, errors.New(diagnosis.Message)
+				}
+			}
+
+			return current.Healthy, nil
+		},
+	)
+
+	if pollErr == nil {
+		fmt.Printf("Rollout of %s complete.\n", endpoint+canary_version)
+		return status, nil
+	}
+
+	if !deadlineExceeded && !wait.Interrupted(pollErr) {
+		return status, pollErr
+	}
+
+	failure := &RolloutFailure{
+		Endpoint:   endpoint,
+		Deployment: endpoint + canary_version,
+		Service:    serviceName,
+		Reason:     "Timeout",
+		Message:    fmt.Sprintf("not ready after %s", timeout),
+		Diagnosis:  make([]Diagnosis, 0),
+		Pods:       make([]PodStatus, 0),
+	}
+
+	if status == nil {
+		return nil, failure
+	}
+
+	if deadlineExceeded {
+		failure.Deadline_exceeded = true
+		failure.Reason = "ProgressDeadlineExceeded"
+		failure.Message = pollErr.Error()
+	}
+
+	failure.Phase = status.Phase
+	failure.Diagnosis = status.Diagnosis
+	failure.Pods = status.Pods
+
+	// Lead with the most specific reason: a pod or container problem
+	// explains a stuck rollout better than the generic timeout.
+	for _, diagnosis := range status.Diagnosis {
+		if failureReasons[diagnosis.Reason] {
+			failure.Reason = diagnosis.Reason
+			failure.Message = diagnosis.Object + ": " + diagnosis.Message
+			break
+		}
+	}
+
+	return status, failure
+}
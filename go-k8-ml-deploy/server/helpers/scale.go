@@ -0,0 +1,605 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	hpav2 "k8s.io/client-go/kubernetes/typed/autoscaling/v2"
+	"k8s.io/client-go/util/retry"
+
+	autoscalingv2ac "k8s.io/client-go/applyconfigurations/autoscaling/v2"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+)
+
+const (
+	// modelConfigAnnotation keeps the request a version was deployed with.
+	modelConfigAnnotation = "mlops.iolap.com/model-deploy"
+
+	// pausedAnnotation holds the replicas of a paused Deployment, which it
+	// gets back when resumed, and pausedByAnnotation is set when a schedule
+	// paused it.
+	pausedAnnotation   = "mlops.iolap.com/paused-replicas"
+	pausedByAnnotation = "mlops.iolap.com/paused-by"
+
+	// A manual scale lasts until scaleUntilAnnotation and then the
+	// autoscaler gets back the bounds, or the Deployment the replicas, in
+	// scaleRestoreAnnotation.
+	scaleUntilAnnotation   = "mlops.iolap.com/scale-until"
+	scaleRestoreAnnotation = "mlops.iolap.com/scale-restore"
+
+	// kedaPausedAnnotation makes KEDA hold a ScaledObject at a replica count.
+	kedaPausedAnnotation = "autoscaling.keda.sh/paused-replicas"
+
+	defaultScaleDuration = time.Hour
+	maxScaleDuration     = 7 * 24 * time.Hour
+
+	// ScaleReconcileInterval is how often expired manual scales are undone
+	// and schedules are applied.
+	ScaleReconcileInterval = 30 * time.Second
+)
+
+// ModelScale is the body of a manual scale. The replica count overrides the
+// autoscaler for Duration_seconds, an hour by default.
+type ModelScale struct {
+	Replicas         *int32 `json:"replicas"`
+	Duration_seconds *int   `json:"duration_seconds"`
+}
+
+type ScaleReturn struct {
+	Endpoint       string
+	Namespace      string
+	Canary_version string
+	Replicas       int32
+	Paused         bool
+	Until          string       `json:",omitempty"`
+	Config         *ModelDeploy `json:",omitempty"`
+}
+
+// configAnnotation is the request saved on the Deployment, so a paused
+// endpoint keeps the parameters it was deployed with. The values of env are
+// left out, they may be credentials. Pausing leaves the pod template alone,
+// so what was resolved from the request, such as the image digest, the
+// accelerator and the security policy, comes back with it on resume.
+func (model *ModelDeploy) configAnnotation() string {
+
+	saved := *model
+	saved.Env = make([]EnvVar, 0, len(model.Env))
+	for _, env := range model.Env {
+		saved.Env = append(saved.Env, EnvVar{Name: env.Name})
+	}
+
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func savedConfig(deployment *appsv1.Deployment) *ModelDeploy {
+
+	saved, ok := deployment.Annotations[modelConfigAnnotation]
+	if !ok {
+		return nil
+	}
+
+	model := new(ModelDeploy)
+	if err := json.Unmarshal([]byte(saved), model); err != nil {
+		return nil
+	}
+
+	return model
+}
+
+// ScaleDuration validates a manual scale request and returns how long it
+// lasts.
+func (scale *ModelScale) ScaleDuration() (time.Duration, error) {
+
+	invalid := make([]*APIError, 0)
+
+	if scale.Replicas == nil {
+		invalid = append(invalid, fieldError("replicas", "is required"))
+	} else if *scale.Replicas < 0 {
+		invalid = append(invalid, fieldError("replicas", "must not be negative"))
+	}
+
+	duration := defaultScaleDuration
+	if scale.Duration_seconds != nil {
+		duration = time.Duration(*scale.Duration_seconds) * time.Second
+		if duration <= 0 || duration > maxScaleDuration {
+			invalid = append(invalid, fieldError("duration_seconds", fmt.Sprintf(
+				"must be between 1 and %d", int(maxScaleDuration.Seconds()),
+			)))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return duration, nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid scale fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return 0, apiErr
+}
+
+func annotationPatch(annotations map[string]interface{}, replicas *int32) []byte {
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	}
+	if replicas != nil {
+		patch["spec"] = map[string]interface{}{"replicas": *replicas}
+	}
+
+	// Maps of strings, nil and integers always marshal.
+	data, _ := json.Marshal(patch)
+
+	return data
+}
+
+// endpointScaler is the autoscaler of a version, at most one of which is set.
+type endpointScaler struct {
+	hpa          *autoscalingv2.HorizontalPodAutoscaler
+	scaledObject *unstructured.Unstructured
+}
+
+func findScaler(ctx context.Context, clients *Clients, endpoint, name string) (*endpointScaler, error) {
+
+	scaler := new(endpointScaler)
+
+	scaledObject, err := clients.ScaledObjects.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, ResourceError("ScaledObject", name, err)
+	}
+	if err == nil && scaledObjectTarget(scaledObject) == name {
+		scaler.scaledObject = scaledObject
+		return scaler, nil
+	}
+
+	hpa, err := findHpa(ctx, clients.Hpas, endpoint, name)
+	if err != nil {
+		return nil, ResourceError("HorizontalPodAutoscaler", name, err)
+	}
+	scaler.hpa = hpa
+
+	return scaler, nil
+}
+
+func getEndpointDeployment(ctx context.Context, clients *Clients, name string) (*appsv1.Deployment, error) {
+	deployment, err := clients.Deployments.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, ResourceError("Deployment", name, err)
+	}
+	return deployment, nil
+}
+
+func patchDeployment(ctx context.Context, clients *Clients, name string, data []byte) error {
+	_, err := clients.Deployments.Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+	})
+	if err != nil {
+		return ResourceError("Deployment", name, err)
+	}
+	return nil
+}
+
+func patchScaledObjectAnnotations(
+	ctx context.Context, clients *Clients, name string, annotations map[string]interface{},
+) error {
+	_, err := clients.ScaledObjects.Patch(ctx, name, types.MergePatchType, annotationPatch(annotations, nil),
+		metav1.PatchOptions{FieldManager: FieldManager},
+	)
+	if err != nil {
+		return ResourceError("ScaledObject", name, err)
+	}
+	return nil
+}
+
+// updateHpa changes the bounds and annotations of an HPA. HPAs applied by
+// this server are applied again, so a later deploy takes the bounds back;
+// older ones are updated.
+func updateHpa(
+	ctx context.Context,
+	hpaClient hpav2.HorizontalPodAutoscalerInterface,
+	hpa *autoscalingv2.HorizontalPodAutoscaler,
+	minReplicas, maxReplicas int32,
+	annotations map[string]string,
+) error {
+
+	if ownsApply(hpa) {
+		config, err := autoscalingv2ac.ExtractHorizontalPodAutoscaler(hpa, FieldManager)
+		if err != nil {
+			return err
+		}
+		for key, value := range annotations {
+			if value == "" {
+				delete(config.Annotations, key)
+			} else {
+				config.WithAnnotations(map[string]string{key: value})
+			}
+		}
+		if config.Spec == nil {
+			config.WithSpec(autoscalingv2ac.HorizontalPodAutoscalerSpec())
+		}
+		config.Spec.WithMinReplicas(minReplicas).WithMaxReplicas(maxReplicas)
+		_, err = hpaClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := hpaClient.Get(ctx, hpa.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if current.Annotations == nil {
+			current.Annotations = make(map[string]string)
+		}
+		for key, value := range annotations {
+			if value == "" {
+				delete(current.Annotations, key)
+			} else {
+				current.Annotations[key] = value
+			}
+		}
+		current.Spec.MinReplicas = &minReplicas
+		current.Spec.MaxReplicas = maxReplicas
+		_, err = hpaClient.Update(ctx, current, metav1.UpdateOptions{FieldManager: FieldManager})
+		return err
+	})
+}
+
+func hpaBounds(hpa *autoscalingv2.HorizontalPodAutoscaler) string {
+	minReplicas := int32(1)
+	if hpa.Spec.MinReplicas != nil {
+		minReplicas = *hpa.Spec.MinReplicas
+	}
+	return fmt.Sprintf("%d,%d", minReplicas, hpa.Spec.MaxReplicas)
+}
+
+func parseBounds(value string) (int32, int32, error) {
+
+	minValue, maxValue, ok := strings.Cut(value, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not min,max", value)
+	}
+	minReplicas, err := strconv.ParseInt(minValue, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxReplicas, err := strconv.ParseInt(maxValue, 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int32(minReplicas), int32(maxReplicas), nil
+}
+
+func newScaleReturn(clients *Clients, endpoint, canary_version string, deployment *appsv1.Deployment) *ScaleReturn {
+	return &ScaleReturn{
+		Endpoint:       endpoint,
+		Namespace:      clients.Namespace,
+		Canary_version: canary_version,
+		Config:         savedConfig(deployment),
+	}
+}
+
+// ScaleEndpoint runs a version at a fixed replica count until the duration
+// has passed. The HPA is pinned with min and max replicas, a ScaledObject is
+// paused at the count and a Deployment without an autoscaler is scaled.
+// Scaling again before it ends replaces the count and the end time.
+func ScaleEndpoint(
+	ctx context.Context, clients *Clients, endpoint, canary_version string, replicas int32, duration time.Duration,
+) (*ScaleReturn, error) {
+
+	name := endpoint + canary_version
+
+	deployment, err := getEndpointDeployment(ctx, clients, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, paused := deployment.Annotations[pausedAnnotation]; paused {
+		return nil, NewAPIError(ErrorConflict, fmt.Sprintf("endpoint %s is paused, resume it first", name))
+	}
+
+	scaler, err := findScaler(ctx, clients, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+
+	until := time.Now().Add(duration).UTC().Format(time.RFC3339)
+
+	switch {
+	case scaler.scaledObject != nil:
+		err = patchScaledObjectAnnotations(ctx, clients, name, map[string]interface{}{
+			kedaPausedAnnotation: strconv.Itoa(int(replicas)),
+			scaleUntilAnnotation: until,
+		})
+
+	case scaler.hpa != nil:
+		if replicas == 0 {
+			return nil, fieldError("replicas", "an HPA cannot scale to 0, pause the endpoint instead")
+		}
+		restore := scaler.hpa.Annotations[scaleRestoreAnnotation]
+		if restore == "" {
+			restore = hpaBounds(scaler.hpa)
+		}
+		err = updateHpa(ctx, clients.Hpas, scaler.hpa, replicas, replicas, map[string]string{
+			scaleUntilAnnotation:   until,
+			scaleRestoreAnnotation: restore,
+		})
+		if err != nil {
+			err = ResourceError("HorizontalPodAutoscaler", scaler.hpa.Name, err)
+		}
+
+	default:
+		restore := deployment.Annotations[scaleRestoreAnnotation]
+		if restore == "" && deployment.Spec.Replicas != nil {
+			restore = strconv.Itoa(int(*deployment.Spec.Replicas))
+		}
+		err = patchDeployment(ctx, clients, name, annotationPatch(map[string]interface{}{
+			scaleUntilAnnotation:   until,
+			scaleRestoreAnnotation: restore,
+		}, &replicas))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Scaled %q to %d replicas until %s.\n", name, replicas, until)
+
+	message := newScaleReturn(clients, endpoint, canary_version, deployment)
+	message.Replicas = replicas
+	message.Until = until
+
+	return message, nil
+}
+
+// PauseEndpoint scales a version to zero and keeps its Service, Ingress,
+// autoscaler and saved config. An HPA stops scaling a Deployment at zero
+// replicas and a ScaledObject is paused, so the version stays down until
+// ResumeEndpoint.
+func PauseEndpoint(ctx context.Context, clients *Clients, endpoint, canary_version string) (*ScaleReturn, error) {
+	return pauseEndpoint(ctx, clients, endpoint, canary_version, nil)
+}
+
+// pauseEndpoint records what paused the version in pausedByAnnotation, nil
+// for a manual pause.
+func pauseEndpoint(
+	ctx context.Context, clients *Clients, endpoint, canary_version string, pausedBy interface{},
+) (*ScaleReturn, error) {
+
+	name := endpoint + canary_version
+
+	deployment, err := getEndpointDeployment(ctx, clients, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, paused := deployment.Annotations[pausedAnnotation]; paused {
+		return nil, NewAPIError(ErrorConflict, fmt.Sprintf("endpoint %s is already paused", name))
+	}
+
+	scaler, err := findScaler(ctx, clients, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+	if scaler.scaledObject != nil {
+		err = patchScaledObjectAnnotations(ctx, clients, name, map[string]interface{}{
+			kedaPausedAnnotation: "0",
+			scaleUntilAnnotation: nil,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	zero := int32(0)
+	err = patchDeployment(ctx, clients, name, annotationPatch(map[string]interface{}{
+		pausedAnnotation:   strconv.Itoa(int(replicas)),
+		pausedByAnnotation: pausedBy,
+	}, &zero))
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Paused %q at %d replicas.\n", name, replicas)
+
+	message := newScaleReturn(clients, endpoint, canary_version, deployment)
+	message.Paused = true
+
+	return message, nil
+}
+
+// ResumeEndpoint brings a paused version back to the replicas it had and
+// lets its autoscaler take over again. Resuming a version during a paused
+// window of its schedules keeps it running until that window ends.
+func ResumeEndpoint(ctx context.Context, clients *Clients, endpoint, canary_version string) (*ScaleReturn, error) {
+
+	name := endpoint + canary_version
+
+	deployment, err := getEndpointDeployment(ctx, clients, name)
+	if err != nil {
+		return nil, err
+	}
+	saved, paused := deployment.Annotations[pausedAnnotation]
+	if !paused {
+		return nil, NewAPIError(ErrorConflict, fmt.Sprintf("endpoint %s is not paused", name))
+	}
+
+	replicas := int32(1)
+	if parsed, err := strconv.ParseInt(saved, 10, 32); err == nil && parsed > 0 {
+		replicas = int32(parsed)
+	}
+
+	// Schedules resume a version once its paused window has ended, so a
+	// paused window that is still active means the resume is manual.
+	var override interface{}
+	if window := activeWindow(savedSchedules(deployment), time.Now()); window != nil && window.Paused {
+		override = window.Name
+	}
+
+	err = patchDeployment(ctx, clients, name, annotationPatch(map[string]interface{}{
+		pausedAnnotation:           nil,
+		pausedByAnnotation:         nil,
+		scheduleOverrideAnnotation: override,
+	}, &replicas))
+	if err != nil {
+		return nil, err
+	}
+
+	scaler, err := findScaler(ctx, clients, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+	if scaler.scaledObject != nil {
+		err = patchScaledObjectAnnotations(ctx, clients, name, map[string]interface{}{
+			kedaPausedAnnotation: nil,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Printf("Resumed %q at %d replicas.\n", name, replicas)
+
+	message := newScaleReturn(clients, endpoint, canary_version, deployment)
+	message.Replicas = replicas
+
+	return message, nil
+}
+
+func scaleExpired(annotations map[string]string, now time.Time) bool {
+	until, err := time.Parse(time.RFC3339, annotations[scaleUntilAnnotation])
+	return err == nil && !now.Before(until)
+}
+
+// RevertExpiredScales gives every autoscaler and Deployment in the namespace
+// whose manual scale has ended its previous bounds or replicas back. A paused
+// Deployment stays at zero. Objects are found by the annotations of the
+// manual scale rather than the managed-by label, which HPAs created before it
+// do not have.
+func RevertExpiredScales(ctx context.Context, clients *Clients) error {
+
+	now := time.Now()
+	listOptions := metav1.ListOptions{}
+	errs := make([]error, 0)
+
+	hpas, err := clients.Hpas.List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+	for i := range hpas.Items {
+		hpa := &hpas.Items[i]
+		if !scaleExpired(hpa.Annotations, now) {
+			continue
+		}
+		minReplicas, maxReplicas, err := parseBounds(hpa.Annotations[scaleRestoreAnnotation])
+		if err != nil {
+			errs = append(errs, ResourceError("HorizontalPodAutoscaler", hpa.Name, err))
+			continue
+		}
+		err = updateHpa(ctx, clients.Hpas, hpa, minReplicas, maxReplicas, map[string]string{
+			scaleUntilAnnotation:   "",
+			scaleRestoreAnnotation: "",
+		})
+		if err != nil {
+			errs = append(errs, ResourceError("HorizontalPodAutoscaler", hpa.Name, err))
+			continue
+		}
+		fmt.Printf("Manual scale of hpa %q ended.\n", hpa.Name)
+	}
+
+	// Clusters without KEDA have no ScaledObjects to list.
+	scaledObjects, err := clients.ScaledObjects.List(ctx, listOptions)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		for _, scaledObject := range scaledObjects.Items {
+			if !scaleExpired(scaledObject.GetAnnotations(), now) {
+				continue
+			}
+			err := patchScaledObjectAnnotations(ctx, clients, scaledObject.GetName(), map[string]interface{}{
+				kedaPausedAnnotation: nil,
+				scaleUntilAnnotation: nil,
+			})
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			fmt.Printf("Manual scale of scaled object %q ended.\n", scaledObject.GetName())
+		}
+	}
+
+	deployments, err := clients.Deployments.List(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments.Items {
+		if !scaleExpired(deployment.Annotations, now) {
+			continue
+		}
+		var replicas *int32
+		_, paused := deployment.Annotations[pausedAnnotation]
+		if parsed, err := strconv.ParseInt(deployment.Annotations[scaleRestoreAnnotation], 10, 32); err == nil && !paused {
+			restored := int32(parsed)
+			replicas = &restored
+		}
+		err := patchDeployment(ctx, clients, deployment.Name, annotationPatch(map[string]interface{}{
+			scaleUntilAnnotation:   nil,
+			scaleRestoreAnnotation: nil,
+		}, replicas))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Manual scale of deployment %q ended.\n", deployment.Name)
+	}
+
+	return JoinErrors(errs)
+}
+
+// ReconcileScales runs RevertExpiredScales and then ApplySchedules for every
+// namespace at a fixed interval until the context ends.
+func ReconcileScales(ctx context.Context, namespaceClients []*Clients, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, clients := range namespaceClients {
+			if err := RevertExpiredScales(ctx, clients); err != nil {
+				fmt.Printf("Reverting manual scales in %s: %s\n", clients.Namespace, err)
+			}
+			if err := ApplySchedules(ctx, clients); err != nil {
+				fmt.Printf("Applying schedules in %s: %s\n", clients.Namespace, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func CreateScaleResponse(message *ScaleReturn) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(message)
+
+	return message_parsed, error
+}
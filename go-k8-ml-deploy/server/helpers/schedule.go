@@ -0,0 +1,388 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	// Schedule time zones are loaded without relying on the image having
+	// tzdata installed.
+	_ "time/tzdata"
+)
+
+const (
+	// schedulesAnnotation keeps the schedules of a version on its
+	// Deployment, so they survive restarts of the server.
+	schedulesAnnotation = "mlops.iolap.com/schedules"
+
+	// The window an HPA is scaled for and the bounds it gets back when no
+	// window is active.
+	activeScheduleAnnotation  = "mlops.iolap.com/schedule"
+	scheduleRestoreAnnotation = "mlops.iolap.com/schedule-restore"
+
+	// scheduleOverrideAnnotation names the paused window a version was
+	// resumed in by hand, which then leaves it running until the window ends.
+	scheduleOverrideAnnotation = "mlops.iolap.com/schedule-override"
+
+	pausedBySchedule = "schedule"
+)
+
+// ScheduleWindow changes how a version is scaled during the minutes matched
+// by Cron, a five field cron expression evaluated in Timezone, UTC by
+// default. "* 8-17 * * mon-fri" is active on weekdays from 08:00 to 18:00.
+// A window either sets the HPA bounds or pauses the version. When windows
+// overlap the first one listed wins; outside every window the version is
+// scaled as it was deployed.
+type ScheduleWindow struct {
+	Name         string `json:"name"`
+	Cron         string `json:"cron"`
+	Timezone     string `json:"timezone"`
+	Min_replicas *int32 `json:"min_replicas"`
+	Max_replicas *int32 `json:"max_replicas"`
+	Paused       bool   `json:"paused"`
+}
+
+type ModelSchedules struct {
+	Schedules []ScheduleWindow `json:"schedules"`
+}
+
+type ScheduleReturn struct {
+	Endpoint       string
+	Namespace      string
+	Canary_version string
+	Schedules      []ScheduleWindow
+}
+
+func (window *ScheduleWindow) location() *time.Location {
+	location, err := time.LoadLocation(window.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// active reports whether the window is active at now. Windows are validated
+// when they are set, one that no longer parses is never active.
+func (window *ScheduleWindow) active(now time.Time) bool {
+	cron, err := parseCron(window.Cron)
+	return err == nil && cron.matches(now.In(window.location()))
+}
+
+// ValidateSchedules rejects windows that would never apply, with the request
+// field names.
+func (schedules *ModelSchedules) ValidateSchedules() error {
+
+	invalid := make([]*APIError, 0)
+	names := make(map[string]bool)
+
+	for i, window := range schedules.Schedules {
+		field := fmt.Sprintf("schedules[%d]", i)
+
+		if errs := validation.IsDNS1123Label(window.Name); len(errs) > 0 {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf("%q: %s", window.Name, errs[0])))
+		}
+		if names[window.Name] {
+			invalid = append(invalid, fieldError(field+".name", fmt.Sprintf("%q is used twice", window.Name)))
+		}
+		names[window.Name] = true
+
+		if _, err := parseCron(window.Cron); err != nil {
+			invalid = append(invalid, fieldError(field+".cron", err.Error()))
+		}
+		if _, err := time.LoadLocation(window.Timezone); err != nil {
+			invalid = append(invalid, fieldError(field+".timezone", fmt.Sprintf("unknown time zone %q", window.Timezone)))
+		}
+
+		bounded := window.Min_replicas != nil || window.Max_replicas != nil
+		if window.Paused == bounded {
+			invalid = append(invalid, fieldError(field, "set paused or min_replicas and max_replicas"))
+			continue
+		}
+		if window.Min_replicas != nil && *window.Min_replicas < 1 {
+			invalid = append(invalid, fieldError(field+".min_replicas", "must be at least 1, pause the version instead"))
+		}
+		if window.Max_replicas != nil && *window.Max_replicas < 1 {
+			invalid = append(invalid, fieldError(field+".max_replicas", "must be at least 1"))
+		}
+		if window.Min_replicas != nil && window.Max_replicas != nil && *window.Max_replicas < *window.Min_replicas {
+			invalid = append(invalid, fieldError(field+".max_replicas", "must not be less than min_replicas"))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid schedule fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
+
+func savedSchedules(deployment *appsv1.Deployment) []ScheduleWindow {
+
+	saved, ok := deployment.Annotations[schedulesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	schedules := make([]ScheduleWindow, 0)
+	if err := json.Unmarshal([]byte(saved), &schedules); err != nil {
+		return nil
+	}
+
+	return schedules
+}
+
+func activeWindow(schedules []ScheduleWindow, now time.Time) *ScheduleWindow {
+	for i := range schedules {
+		if schedules[i].active(now) {
+			return &schedules[i]
+		}
+	}
+	return nil
+}
+
+// SetSchedules replaces the schedules of a version; an empty list removes
+// them. Windows with replica bounds need the version to be scaled by an HPA.
+func SetSchedules(
+	ctx context.Context, clients *Clients, endpoint, canary_version string, schedules []ScheduleWindow,
+) (*ScheduleReturn, error) {
+
+	name := endpoint + canary_version
+
+	deployment, err := getEndpointDeployment(ctx, clients, name)
+	if err != nil {
+		return nil, err
+	}
+
+	scaler, err := findScaler(ctx, clients, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+	for i, window := range schedules {
+		if !window.Paused && scaler.hpa == nil {
+			return nil, fieldError(fmt.Sprintf("schedules[%d]", i), fmt.Sprintf(
+				"%s is not scaled by an HPA, only paused windows apply", name,
+			))
+		}
+	}
+
+	var saved interface{}
+	if len(schedules) > 0 {
+		data, err := json.Marshal(schedules)
+		if err != nil {
+			return nil, err
+		}
+		saved = string(data)
+	} else {
+		schedules = make([]ScheduleWindow, 0)
+	}
+
+	if err := patchDeployment(ctx, clients, name, annotationPatch(map[string]interface{}{
+		schedulesAnnotation: saved,
+	}, nil)); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Set %d schedules on %q.\n", len(schedules), deployment.Name)
+
+	// Applied right away rather than on the next tick of the scheduler.
+	deployment, err = getEndpointDeployment(ctx, clients, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := applySchedules(ctx, clients, endpoint, canary_version, deployment, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &ScheduleReturn{
+		Endpoint:       endpoint,
+		Namespace:      clients.Namespace,
+		Canary_version: canary_version,
+		Schedules:      schedules,
+	}, nil
+}
+
+func scaleActive(annotations map[string]string, now time.Time) bool {
+	return annotations[scaleUntilAnnotation] != "" && !scaleExpired(annotations, now)
+}
+
+// applySchedules brings a version in line with the window active at now. A
+// manual pause, a manual scale that has not ended and a manual resume during
+// the current paused window take precedence over the schedules.
+func applySchedules(
+	ctx context.Context, clients *Clients, endpoint, canary_version string, deployment *appsv1.Deployment, now time.Time,
+) error {
+
+	window := activeWindow(savedSchedules(deployment), now)
+
+	_, paused := deployment.Annotations[pausedAnnotation]
+	pausedByUs := deployment.Annotations[pausedByAnnotation] == pausedBySchedule
+
+	override := deployment.Annotations[scheduleOverrideAnnotation]
+	if override != "" && (window == nil || window.Name != override) {
+		if err := patchDeployment(ctx, clients, deployment.Name, annotationPatch(map[string]interface{}{
+			scheduleOverrideAnnotation: nil,
+		}, nil)); err != nil {
+			return err
+		}
+		override = ""
+	}
+
+	scaler, err := findScaler(ctx, clients, endpoint, deployment.Name)
+	if err != nil {
+		return err
+	}
+
+	if window != nil && window.Paused {
+		if paused || override == window.Name {
+			return nil
+		}
+		if scaleActive(deployment.Annotations, now) ||
+			(scaler.hpa != nil && scaleActive(scaler.hpa.Annotations, now)) ||
+			(scaler.scaledObject != nil && scaleActive(scaler.scaledObject.GetAnnotations(), now)) {
+			return nil
+		}
+		fmt.Printf("Schedule %q pauses %q.\n", window.Name, deployment.Name)
+		_, err = pauseEndpoint(ctx, clients, endpoint, canary_version, pausedBySchedule)
+		return err
+	}
+
+	if paused && !pausedByUs {
+		return nil
+	}
+	if paused {
+		fmt.Printf("Schedule pause of %q ended.\n", deployment.Name)
+		if _, err := ResumeEndpoint(ctx, clients, endpoint, canary_version); err != nil {
+			return err
+		}
+	}
+
+	hpa := scaler.hpa
+	if hpa == nil || hpa.Annotations[scaleUntilAnnotation] != "" {
+		return nil
+	}
+
+	current := hpa.Annotations[activeScheduleAnnotation]
+	restore := hpa.Annotations[scheduleRestoreAnnotation]
+
+	if window == nil {
+		if current == "" {
+			return nil
+		}
+		minReplicas, maxReplicas, err := parseBounds(restore)
+		if err != nil {
+			return ResourceError("HorizontalPodAutoscaler", hpa.Name, err)
+		}
+		fmt.Printf("Schedule %q of %q ended.\n", current, deployment.Name)
+		return updateHpa(ctx, clients.Hpas, hpa, minReplicas, maxReplicas, map[string]string{
+			activeScheduleAnnotation:  "",
+			scheduleRestoreAnnotation: "",
+		})
+	}
+
+	if current == window.Name {
+		return nil
+	}
+	if restore == "" {
+		restore = hpaBounds(hpa)
+	}
+	minReplicas, maxReplicas, err := parseBounds(restore)
+	if err != nil {
+		return ResourceError("HorizontalPodAutoscaler", hpa.Name, err)
+	}
+	if window.Min_replicas != nil {
+		minReplicas = *window.Min_replicas
+	}
+	if window.Max_replicas != nil {
+		maxReplicas = *window.Max_replicas
+	}
+	if maxReplicas < minReplicas {
+		maxReplicas = minReplicas
+	}
+
+	fmt.Printf("Schedule %q scales %q to %d-%d replicas.\n", window.Name, deployment.Name, minReplicas, maxReplicas)
+
+	return updateHpa(ctx, clients.Hpas, hpa, minReplicas, maxReplicas, map[string]string{
+		activeScheduleAnnotation:  window.Name,
+		scheduleRestoreAnnotation: restore,
+	})
+}
+
+// ApplySchedules applies the schedules of every version in the namespace.
+func ApplySchedules(ctx context.Context, clients *Clients) error {
+
+	// Endpoints deployed before the managed-by label have schedules too.
+	deployments, err := clients.Deployments.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	errs := make([]error, 0)
+
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if _, ok := deployment.Annotations[schedulesAnnotation]; !ok &&
+			deployment.Annotations[pausedByAnnotation] != pausedBySchedule {
+			continue
+		}
+		if !managedDeployment(deployment) {
+			continue
+		}
+		endpoint, canary_version := endpointVersion(deployment)
+		if err := applySchedules(ctx, clients, endpoint, canary_version, deployment, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return JoinErrors(errs)
+}
+
+// TransitionSchedules moves the schedules of the stable version to the
+// canary that replaces it, unless the canary has schedules of its own. It
+// runs first in /transition, so a missing canary fails the transition before
+// anything is changed.
+func TransitionSchedules(ctx context.Context, clients *Clients, endpoint, toDestroy string) error {
+
+	canary, err := getEndpointDeployment(ctx, clients, toDestroy)
+	if err != nil {
+		return err
+	}
+	if _, ok := canary.Annotations[schedulesAnnotation]; ok {
+		fmt.Printf("Keeping the schedules of %q.\n", toDestroy)
+		return nil
+	}
+
+	stable, err := clients.Deployments.Get(ctx, endpoint, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return ResourceError("Deployment", endpoint, err)
+	}
+
+	saved, ok := stable.Annotations[schedulesAnnotation]
+	if !ok {
+		return nil
+	}
+
+	return patchDeployment(ctx, clients, toDestroy, annotationPatch(map[string]interface{}{
+		schedulesAnnotation: saved,
+	}, nil))
+}
+
+func CreateScheduleResponse(message *ScheduleReturn) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(message)
+
+	return message_parsed, error
+}
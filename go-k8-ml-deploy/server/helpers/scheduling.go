@@ -0,0 +1,189 @@
+package helpers
+
+import (
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const zoneTopologyKey = "topology.kubernetes.io/zone"
+
+// spotNodeLabels are the labels the common cloud providers and Karpenter put
+// on spot or preemptible nodes. It is a list so the rendered pod template
+// does not change between deploys and trigger a rollout.
+var spotNodeLabels = []struct {
+	label string
+	value string
+}{
+	{"karpenter.sh/capacity-type", "spot"},
+	{"eks.amazonaws.com/capacityType", "SPOT"},
+	{"cloud.google.com/gke-spot", "true"},
+	{"kubernetes.azure.com/scalesetpriority", "spot"},
+}
+
+// Scheduling holds the pod scheduling settings of a model. Affinity, tolerations
+// and topology spread constraints use the Kubernetes field names. A topology
+// spread constraint without a label selector spreads the pods of the model's
+// own deployment.
+type Scheduling struct {
+	Node_selector               map[string]string                `json:"node_selector"`
+	Affinity                    *apiv1.Affinity                  `json:"affinity"`
+	Tolerations                 []apiv1.Toleration               `json:"tolerations"`
+	Topology_spread_constraints []apiv1.TopologySpreadConstraint `json:"topology_spread_constraints"`
+	Priority_class_name         string                           `json:"priority_class_name"`
+}
+
+// defaultStageScheduling spreads production models across zones and keeps
+// them off spot nodes, and lets staging models run on spot nodes.
+func defaultStageScheduling() map[string]Scheduling {
+
+	notSpot := make([]apiv1.NodeSelectorRequirement, 0, len(spotNodeLabels))
+	spot := make([]apiv1.PreferredSchedulingTerm, 0, len(spotNodeLabels))
+	for _, node := range spotNodeLabels {
+		notSpot = append(notSpot, apiv1.NodeSelectorRequirement{
+			Key: node.label, Operator: apiv1.NodeSelectorOpNotIn, Values: []string{node.value},
+		})
+		spot = append(spot, apiv1.PreferredSchedulingTerm{
+			Weight: 50,
+			Preference: apiv1.NodeSelectorTerm{
+				MatchExpressions: []apiv1.NodeSelectorRequirement{
+					{Key: node.label, Operator: apiv1.NodeSelectorOpIn, Values: []string{node.value}},
+				},
+			},
+		})
+	}
+
+	return map[string]Scheduling{
+		"Production": {
+			Affinity: &apiv1.Affinity{
+				NodeAffinity: &apiv1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+						NodeSelectorTerms: []apiv1.NodeSelectorTerm{{MatchExpressions: notSpot}},
+					},
+				},
+			},
+			Topology_spread_constraints: []apiv1.TopologySpreadConstraint{
+				{
+					MaxSkew:           1,
+					TopologyKey:       zoneTopologyKey,
+					WhenUnsatisfiable: apiv1.ScheduleAnyway,
+				},
+			},
+		},
+		"Staging": {
+			Affinity: &apiv1.Affinity{
+				NodeAffinity: &apiv1.NodeAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: spot,
+				},
+			},
+			Tolerations: []apiv1.Toleration{
+				{
+					Key:      "kubernetes.azure.com/scalesetpriority",
+					Operator: apiv1.TolerationOpEqual,
+					Value:    "spot",
+					Effect:   apiv1.TaintEffectNoSchedule,
+				},
+			},
+		},
+	}
+}
+
+func stageScheduling(stages map[string]Scheduling, stage string) (Scheduling, bool) {
+	for name, scheduling := range stages {
+		if strings.EqualFold(name, stage) {
+			return scheduling, true
+		}
+	}
+	return Scheduling{}, false
+}
+
+// ResolveScheduling fills in the scheduling defaults of the model stage. The
+// config can replace the built-in defaults of a stage; settings on the
+// request win over both, and node selectors are merged key by key.
+func (config *ServerConfig) ResolveScheduling(model *ModelDeploy) {
+
+	defaults, ok := stageScheduling(config.Stage_scheduling, model.Model_stage)
+	if !ok {
+		defaults, ok = stageScheduling(defaultStageScheduling(), model.Model_stage)
+	}
+	if !ok {
+		return
+	}
+
+	if model.Scheduling == nil {
+		model.Scheduling = new(Scheduling)
+	}
+	scheduling := model.Scheduling
+
+	scheduling.Node_selector = mergeLabels(defaults.Node_selector, scheduling.Node_selector)
+
+	if scheduling.Affinity == nil {
+		scheduling.Affinity = defaults.Affinity
+	} else if defaults.Affinity != nil {
+		if scheduling.Affinity.NodeAffinity == nil {
+			scheduling.Affinity.NodeAffinity = defaults.Affinity.NodeAffinity
+		}
+		if scheduling.Affinity.PodAffinity == nil {
+			scheduling.Affinity.PodAffinity = defaults.Affinity.PodAffinity
+		}
+		if scheduling.Affinity.PodAntiAffinity == nil {
+			scheduling.Affinity.PodAntiAffinity = defaults.Affinity.PodAntiAffinity
+		}
+	}
+
+	if scheduling.Tolerations == nil {
+		scheduling.Tolerations = defaults.Tolerations
+	}
+	if scheduling.Topology_spread_constraints == nil {
+		scheduling.Topology_spread_constraints = defaults.Topology_spread_constraints
+	}
+	if scheduling.Priority_class_name == "" {
+		scheduling.Priority_class_name = defaults.Priority_class_name
+	}
+}
+
+func mergeLabels(base, override map[string]string) map[string]string {
+
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// applyScheduling sets the scheduling fields of the pod spec of the deployment
+// name from the model scheduling and its accelerator.
+func (model *ModelDeploy) applyScheduling(spec *apiv1.PodSpec, name string) {
+
+	scheduling := model.Scheduling
+	if scheduling == nil {
+		scheduling = new(Scheduling)
+	}
+
+	spec.NodeSelector = mergeLabels(scheduling.Node_selector, model.Accelerator.podNodeSelector())
+	spec.Affinity = scheduling.Affinity
+	spec.PriorityClassName = scheduling.Priority_class_name
+
+	tolerations := append([]apiv1.Toleration(nil), scheduling.Tolerations...)
+	spec.Tolerations = append(tolerations, model.Accelerator.podTolerations()...)
+
+	spec.TopologySpreadConstraints = nil
+	for _, constraint := range scheduling.Topology_spread_constraints {
+		if constraint.LabelSelector == nil {
+			constraint.LabelSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": name},
+			}
+		}
+		spec.TopologySpreadConstraints = append(spec.TopologySpreadConstraints, constraint)
+	}
+}
@@ -0,0 +1,170 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	tmpVolume = "tmp"
+
+	// unprivilegedUser runs the artifact download containers, whose images
+	// default to root.
+	unprivilegedUser = int64(65534)
+)
+
+// SecurityPolicy relaxes the hardened pod defaults for a namespace. The zero
+// value keeps every default: non-root, read-only root filesystem with a
+// writable /tmp, all capabilities dropped, no privilege escalation and the
+// RuntimeDefault seccomp profile. When Service_accounts is set, models may
+// only run as one of those service accounts.
+type SecurityPolicy struct {
+	Allow_root                 bool                     `json:"allow_root"`
+	Writable_root_filesystem   bool                     `json:"writable_root_filesystem"`
+	Allow_privilege_escalation bool                     `json:"allow_privilege_escalation"`
+	Add_capabilities           []apiv1.Capability       `json:"add_capabilities"`
+	Seccomp_profile            apiv1.SeccompProfileType `json:"seccomp_profile"`
+	Run_as_user                *int64                   `json:"run_as_user"`
+	Run_as_group               *int64                   `json:"run_as_group"`
+	Fs_group                   *int64                   `json:"fs_group"`
+	Service_accounts           []string                 `json:"service_accounts"`
+}
+
+func (config *ServerConfig) securityPolicy(namespace string) SecurityPolicy {
+	if policy, ok := config.Security_policies[namespace]; ok {
+		return policy
+	}
+	return config.Security_policies[anyNamespace]
+}
+
+// validateSecurityPolicies rejects policies the pod could not be built with,
+// when the config is loaded.
+func (config *ServerConfig) validateSecurityPolicies() error {
+
+	namespaces := make([]string, 0, len(config.Security_policies))
+	for namespace := range config.Security_policies {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		switch profile := config.Security_policies[namespace].Seccomp_profile; profile {
+		case "", apiv1.SeccompProfileTypeRuntimeDefault, apiv1.SeccompProfileTypeUnconfined:
+		default:
+			return fmt.Errorf("security policy for %s: unsupported seccomp profile %q", namespace, profile)
+		}
+	}
+
+	return nil
+}
+
+// ResolveSecurity checks the service account of a model against the
+// namespace policy and attaches the policy for building the pod.
+func (config *ServerConfig) ResolveSecurity(model *ModelDeploy) error {
+
+	policy := config.securityPolicy(model.Namespace)
+
+	if model.Service_account != "" {
+		if errs := validation.IsDNS1123Subdomain(model.Service_account); len(errs) > 0 {
+			return fieldError("service_account", fmt.Sprintf("%q: %s", model.Service_account, errs[0]))
+		}
+		if len(policy.Service_accounts) > 0 {
+			allowed := false
+			for _, name := range policy.Service_accounts {
+				if name == model.Service_account {
+					allowed = true
+				}
+			}
+			if !allowed {
+				apiErr := fieldError("service_account", fmt.Sprintf(
+					"service account %q is not allowed in namespace %s", model.Service_account, model.Namespace,
+				))
+				apiErr.Code = ErrorForbidden
+				apiErr.Status = StatusForCode(ErrorForbidden)
+				return apiErr
+			}
+		}
+	}
+
+	model.security = &policy
+
+	return nil
+}
+
+func (policy *SecurityPolicy) containerContext() *apiv1.SecurityContext {
+
+	readOnly := !policy.Writable_root_filesystem
+	escalation := policy.Allow_privilege_escalation
+
+	return &apiv1.SecurityContext{
+		ReadOnlyRootFilesystem:   &readOnly,
+		AllowPrivilegeEscalation: &escalation,
+		Capabilities: &apiv1.Capabilities{
+			Drop: []apiv1.Capability{"ALL"},
+			Add:  policy.Add_capabilities,
+		},
+	}
+}
+
+// applySecurity sets the service account and the security contexts of the
+// pod, and gives every container a writable /tmp when the root filesystem is
+// read-only.
+func (model *ModelDeploy) applySecurity(spec *apiv1.PodSpec) {
+
+	policy := model.security
+	if policy == nil {
+		policy = new(SecurityPolicy)
+	}
+
+	spec.ServiceAccountName = model.Service_account
+	if model.Service_account == "" {
+		automount := false
+		spec.AutomountServiceAccountToken = &automount
+	}
+
+	seccomp := policy.Seccomp_profile
+	if seccomp == "" {
+		seccomp = apiv1.SeccompProfileTypeRuntimeDefault
+	}
+	nonRoot := !policy.Allow_root
+
+	spec.SecurityContext = &apiv1.PodSecurityContext{
+		RunAsNonRoot:   &nonRoot,
+		RunAsUser:      policy.Run_as_user,
+		RunAsGroup:     policy.Run_as_group,
+		FSGroup:        policy.Fs_group,
+		SeccompProfile: &apiv1.SeccompProfile{Type: seccomp},
+	}
+
+	if !policy.Writable_root_filesystem {
+		spec.Volumes = append(spec.Volumes, apiv1.Volume{
+			Name:         tmpVolume,
+			VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+		})
+	}
+
+	tmpMount := apiv1.VolumeMount{Name: tmpVolume, MountPath: "/tmp"}
+
+	for i := range spec.Containers {
+		spec.Containers[i].SecurityContext = policy.containerContext()
+		if !policy.Writable_root_filesystem {
+			spec.Containers[i].VolumeMounts = append(spec.Containers[i].VolumeMounts, tmpMount)
+		}
+	}
+
+	for i := range spec.InitContainers {
+		securityContext := policy.containerContext()
+		if !policy.Allow_root && policy.Run_as_user == nil {
+			user := unprivilegedUser
+			securityContext.RunAsUser = &user
+		}
+		spec.InitContainers[i].SecurityContext = securityContext
+		if !policy.Writable_root_filesystem {
+			spec.InitContainers[i].VolumeMounts = append(spec.InitContainers[i].VolumeMounts, tmpMount)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	hpav2 "k8s.io/client-go/kubernetes/typed/autoscaling/v2"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	PhaseMissing     = "Missing"
+	PhaseProgressing = "Progressing"
+	PhaseAvailable   = "Available"
+	PhaseFailed      = "Failed"
+	PhasePaused      = "Paused"
+)
+
+// failureReasons are container and scheduling reasons that will not resolve
+// on their own, so the endpoint is reported as failed rather than progressing.
+var failureReasons = map[string]bool{
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"OOMKilled":                  true,
+	"Unschedulable":              true,
+	"ProgressDeadlineExceeded":   true,
+}
+
+type Diagnosis struct {
+	Object  string
+	Reason  string
+	Message string
+}
+
+type DeploymentCondition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+}
+
+type ContainerStatus struct {
+	Name          string
+	Ready         bool
+	Restart_count int32
+	State         string
+	Reason        string
+	Message       string
+	Last_reason   string
+}
+
+type PodStatus struct {
+	Name       string
+	Phase      string
+	Node       string
+	Ready      bool
+	Reason     string
+	Message    string
+	Containers []ContainerStatus
+}
+
+type HpaMetric struct {
+	Type    string
+	Name    string
+	Current string
+}
+
+type HpaStatus struct {
+	Name             string
+	Min_replicas     int32
+	Max_replicas     int32
+	Current_replicas int32
+	Desired_replicas int32
+	Metrics          []HpaMetric
+}
+
+type EndpointStatus struct {
+	Endpoint             string
+	Namespace            string
+	Canary_version       string
+	Deployment           string
+	Phase                string
+	Healthy              bool
+	Diagnosis            []Diagnosis
+	Replicas             int32
+	Ready_replicas       int32
+	Updated_replicas     int32
+	Available_replicas   int32
+	Unavailable_replicas int32
+	Conditions           []DeploymentCondition
+	Pods                 []PodStatus
+	Hpa                  *HpaStatus
+	Service_ready        bool
+	Ready_endpoints      int
+	Not_ready_endpoints  int
+	Scale_until          string           `json:",omitempty"`
+	Schedules            []ScheduleWindow `json:",omitempty"`
+	Active_schedule      string           `json:",omitempty"`
+}
+
+func ParseEndpointName(name string) (string, error) {
+
+	r, err := regexp.Compile(`[\W_]`)
+	if err != nil {
+		return "", err
+	}
+	parsed_endpoint := r.ReplaceAllString(strings.ToLower(name), "")
+
+	runes := []rune(parsed_endpoint)
+
+	if len(runes) >= 14 {
+		return string(runes[:13]), nil
+	}
+
+	return string(runes), nil
+}
+
+func podStatus(pod *apiv1.Pod) (PodStatus, []Diagnosis) {
+
+	status := PodStatus{
+		Name:    pod.Name,
+		Phase:   string(pod.Status.Phase),
+		Node:    pod.Spec.NodeName,
+		Reason:  pod.Status.Reason,
+		Message: pod.Status.Message,
+	}
+	diagnosis := make([]Diagnosis, 0)
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			status.Ready = condition.Status == apiv1.ConditionTrue
+		}
+		if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionFalse {
+			status.Reason = condition.Reason
+			status.Message = condition.Message
+			diagnosis = append(diagnosis, Diagnosis{
+				Object:  "pod/" + pod.Name,
+				Reason:  condition.Reason,
+				Message: condition.Message,
+			})
+		}
+	}
+
+	for _, container := range pod.Status.ContainerStatuses {
+		containerStatus := ContainerStatus{
+			Name:          container.Name,
+			Ready:         container.Ready,
+			Restart_count: container.RestartCount,
+		}
+
+		switch {
+		case container.State.Waiting != nil:
+			containerStatus.State = "Waiting"
+			containerStatus.Reason = container.State.Waiting.Reason
+			containerStatus.Message = container.State.Waiting.Message
+		case container.State.Terminated != nil:
+			containerStatus.State = "Terminated"
+			containerStatus.Reason = container.State.Terminated.Reason
+			containerStatus.Message = container.State.Terminated.Message
+		case container.State.Running != nil:
+			containerStatus.State = "Running"
+		}
+
+		if container.LastTerminationState.Terminated != nil {
+			containerStatus.Last_reason = container.LastTerminationState.Terminated.Reason
+		}
+
+		if containerStatus.Reason != "" && containerStatus.Reason != "ContainerCreating" &&
+			containerStatus.Reason != "PodInitializing" && containerStatus.Reason != "Completed" {
+			diagnosis = append(diagnosis, Diagnosis{
+				Object:  "pod/" + pod.Name + "/" + container.Name,
+				Reason:  containerStatus.Reason,
+				Message: containerStatus.Message,
+			})
+		}
+		if containerStatus.Last_reason == "OOMKilled" && containerStatus.Reason != "OOMKilled" &&
+			!container.Ready {
+			diagnosis = append(diagnosis, Diagnosis{
+				Object:  "pod/" + pod.Name + "/" + container.Name,
+				Reason:  "OOMKilled",
+				Message: "last run was killed for exceeding its memory limit",
+			})
+		}
+
+		status.Containers = append(status.Containers, containerStatus)
+	}
+
+	return status, diagnosis
+}
+
+func metricStatus(metric autoscalingv2.MetricStatus) HpaMetric {
+
+	hpaMetric := HpaMetric{Type: string(metric.Type)}
+
+	var current autoscalingv2.MetricValueStatus
+	switch {
+	case metric.Resource != nil:
+		hpaMetric.Name = string(metric.Resource.Name)
+		current = metric.Resource.Current
+	case metric.ContainerResource != nil:
+		hpaMetric.Name = string(metric.ContainerResource.Name)
+		current = metric.ContainerResource.Current
+	case metric.Pods != nil:
+		hpaMetric.Name = metric.Pods.Metric.Name
+		current = metric.Pods.Current
+	case metric.Object != nil:
+		hpaMetric.Name = metric.Object.Metric.Name
+		current = metric.Object.Current
+	case metric.External != nil:
+		hpaMetric.Name = metric.External.Metric.Name
+		current = metric.External.Current
+	}
+
+	switch {
+	case current.AverageUtilization != nil:
+		hpaMetric.Current = fmt.Sprintf("%d%%", *current.AverageUtilization)
+	case current.AverageValue != nil:
+		hpaMetric.Current = current.AverageValue.String()
+	case current.Value != nil:
+		hpaMetric.Current = current.Value.String()
+	}
+
+	return hpaMetric
+}
+
+// findHpa returns the HPA scaling a deployment. Every version has its own HPA
+// named after its deployment, or made by KEDA for its ScaledObject; endpoints
+// deployed before that share one named after the endpoint.
+func findHpa(
+	ctx context.Context, hpaClient hpav2.HorizontalPodAutoscalerInterface, endpoint, deploymentName string,
+) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+
+	for _, name := range []string{deploymentName, kedaHpaPrefix + deploymentName, endpoint} {
+		hpa, err := hpaClient.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hpa.Spec.ScaleTargetRef.Name == deploymentName {
+			return hpa, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func deploymentPhase(deployment *appsv1.Deployment, status *EndpointStatus) string {
+
+	for _, diagnosis := range status.Diagnosis {
+		if failureReasons[diagnosis.Reason] {
+			return PhaseFailed
+		}
+	}
+
+	available := false
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentAvailable && condition.Status == apiv1.ConditionTrue {
+			available = true
+		}
+	}
+
+	// Same completion check as kubectl rollout status: no replicas of an
+	// older template are left and every updated replica is available.
+	if available && deployment.Status.ObservedGeneration >= deployment.Generation &&
+		deployment.Status.UpdatedReplicas == status.Replicas &&
+		deployment.Status.Replicas == deployment.Status.UpdatedReplicas &&
+		deployment.Status.AvailableReplicas == deployment.Status.UpdatedReplicas {
+		return PhaseAvailable
+	}
+
+	return PhaseProgressing
+}
+
+// serviceEndpoints counts the ready and not ready addresses behind a Service.
+func serviceEndpoints(ctx context.Context, clients *Clients, name string) (int, int, error) {
+
+	ready, notReady := 0, 0
+
+	endpoints, err := clients.Endpoints.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+		notReady += len(subset.NotReadyAddresses)
+	}
+
+	return ready, notReady, nil
+}
+
+// deploymentService finds the Service that routes to a version: its own, or
+// the stable Service of the endpoint once /transition has promoted it and
+// removed its own.
+func deploymentService(
+	ctx context.Context, clients *Clients, endpoint string, deployment *appsv1.Deployment,
+) (string, error) {
+
+	for _, name := range []string{deployment.Name, endpoint} {
+		service, err := clients.Services.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if selects(service, deployment) {
+			return name, nil
+		}
+	}
+
+	return deployment.Name, nil
+}
+
+func GetEndpointStatus(
+	ctx context.Context, clients *Clients, endpoint, canary_version string,
+) (*EndpointStatus, error) {
+
+	name := endpoint + canary_version
+
+	status := &EndpointStatus{
+		Endpoint:       endpoint,
+		Namespace:      clients.Namespace,
+		Canary_version: canary_version,
+		Deployment:     name,
+		Diagnosis:      make([]Diagnosis, 0),
+		Conditions:     make([]DeploymentCondition, 0),
+		Pods:           make([]PodStatus, 0),
+	}
+
+	deployment, err := clients.Deployments.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			status.Phase = PhaseMissing
+			status.Diagnosis = append(status.Diagnosis, Diagnosis{
+				Object:  "deployment/" + name,
+				Reason:  "NotFound",
+				Message: fmt.Sprintf("deployment %s not found", name),
+			})
+			return status, nil
+		}
+		return nil, err
+	}
+
+	if deployment.Spec.Replicas != nil {
+		status.Replicas = *deployment.Spec.Replicas
+	}
+	status.Ready_replicas = deployment.Status.ReadyReplicas
+	status.Updated_replicas = deployment.Status.UpdatedReplicas
+	status.Available_replicas = deployment.Status.AvailableReplicas
+	status.Unavailable_replicas = deployment.Status.UnavailableReplicas
+
+	// Until the controller has observed the latest spec the conditions still
+	// describe the previous rollout, such as a progress deadline it exceeded.
+	observed := deployment.Status.ObservedGeneration >= deployment.Generation
+
+	for _, condition := range deployment.Status.Conditions {
+		status.Conditions = append(status.Conditions, DeploymentCondition{
+			Type:    string(condition.Type),
+			Status:  string(condition.Status),
+			Reason:  condition.Reason,
+			Message: condition.Message,
+		})
+		if observed && condition.Status == apiv1.ConditionFalse {
+			status.Diagnosis = append(status.Diagnosis, Diagnosis{
+				Object:  "deployment/" + name,
+				Reason:  condition.Reason,
+				Message: condition.Message,
+			})
+		}
+	}
+
+	selector := metav1.FormatLabelSelector(deployment.Spec.Selector)
+	pods, err := clients.Pods.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pods.Items {
+		pod, diagnosis := podStatus(&pods.Items[i])
+		status.Pods = append(status.Pods, pod)
+		status.Diagnosis = append(status.Diagnosis, diagnosis...)
+	}
+
+	service, err := deploymentService(ctx, clients, endpoint, deployment)
+	if err != nil {
+		return nil, err
+	}
+	status.Ready_endpoints, status.Not_ready_endpoints, err = serviceEndpoints(ctx, clients, service)
+	if err != nil {
+		return nil, err
+	}
+	status.Service_ready = status.Ready_endpoints > 0
+	if !status.Service_ready {
+		status.Diagnosis = append(status.Diagnosis, Diagnosis{
+			Object:  "service/" + service,
+			Reason:  "NoReadyEndpoints",
+			Message: fmt.Sprintf("service %s has no ready endpoints", service),
+		})
+	}
+
+	hpa, err := findHpa(ctx, clients.Hpas, endpoint, name)
+	if err != nil {
+		return nil, err
+	}
+	if hpa != nil {
+		status.Hpa = &HpaStatus{
+			Name:             hpa.Name,
+			Max_replicas:     hpa.Spec.MaxReplicas,
+			Current_replicas: hpa.Status.CurrentReplicas,
+			Desired_replicas: hpa.Status.DesiredReplicas,
+			Metrics:          make([]HpaMetric, 0),
+		}
+		if hpa.Spec.MinReplicas != nil {
+			status.Hpa.Min_replicas = *hpa.Spec.MinReplicas
+		}
+		for _, metric := range hpa.Status.CurrentMetrics {
+			status.Hpa.Metrics = append(status.Hpa.Metrics, metricStatus(metric))
+		}
+	}
+
+	status.Phase = deploymentPhase(deployment, status)
+	if _, paused := deployment.Annotations[pausedAnnotation]; paused {
+		status.Phase = PhasePaused
+	}
+	status.Healthy = status.Phase == PhaseAvailable && status.Service_ready
+
+	status.Schedules = savedSchedules(deployment)
+	if window := activeWindow(status.Schedules, time.Now()); window != nil {
+		status.Active_schedule = window.Name
+	}
+
+	status.Scale_until = deployment.Annotations[scaleUntilAnnotation]
+	if hpa != nil && hpa.Annotations[scaleUntilAnnotation] != "" {
+		status.Scale_until = hpa.Annotations[scaleUntilAnnotation]
+	}
+
+	return status, nil
+}
+
+func CreateStatusResponse(status *EndpointStatus) ([]byte, error) {
+
+	message_parsed, error := json.Marshal(status)
+
+	return message_parsed, error
+}
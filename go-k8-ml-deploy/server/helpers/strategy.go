@@ -0,0 +1,129 @@
+package helpers
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// rolloutMargin is added to a progress deadline when it sets the default
+// wait timeout, so the deadline is reported before the wait gives up.
+const rolloutMargin = 30 * time.Second
+
+// Strategy configures how a new version replaces the running pods. GPU
+// models that cannot get a spare accelerator use Recreate or
+// max_surge 0 / max_unavailable 1; latency critical models use
+// max_unavailable 0. Max_surge and Max_unavailable take a count or a
+// percentage such as "25%".
+type Strategy struct {
+	Type                      string              `json:"type"`
+	Max_surge                 *intstr.IntOrString `json:"max_surge"`
+	Max_unavailable           *intstr.IntOrString `json:"max_unavailable"`
+	Min_ready_seconds         *int32              `json:"min_ready_seconds"`
+	Progress_deadline_seconds *int32              `json:"progress_deadline_seconds"`
+	Revision_history_limit    *int32              `json:"revision_history_limit"`
+}
+
+func zeroIntOrString(value *intstr.IntOrString) bool {
+	return value != nil && (value.String() == "0" || value.String() == "0%")
+}
+
+// ValidateStrategy rejects strategy settings the API server would refuse,
+// with the request field names.
+func (model *ModelDeploy) ValidateStrategy() error {
+
+	strategy := model.Strategy
+	if strategy == nil {
+		return nil
+	}
+
+	invalid := make([]*APIError, 0)
+
+	switch appsv1.DeploymentStrategyType(strategy.Type) {
+	case "", appsv1.RollingUpdateDeploymentStrategyType:
+		if zeroIntOrString(strategy.Max_surge) && zeroIntOrString(strategy.Max_unavailable) {
+			invalid = append(invalid, fieldError("strategy.max_unavailable", "may not be 0 when max_surge is 0"))
+		}
+	case appsv1.RecreateDeploymentStrategyType:
+		if strategy.Max_surge != nil || strategy.Max_unavailable != nil {
+			invalid = append(invalid, fieldError("strategy.type", "Recreate does not take max_surge or max_unavailable"))
+		}
+	default:
+		invalid = append(invalid, fieldError("strategy.type", fmt.Sprintf(
+			"unknown strategy %q, use RollingUpdate or Recreate", strategy.Type,
+		)))
+	}
+
+	if strategy.Min_ready_seconds != nil && *strategy.Min_ready_seconds < 0 {
+		invalid = append(invalid, fieldError("strategy.min_ready_seconds", "must not be negative"))
+	}
+	if strategy.Revision_history_limit != nil && *strategy.Revision_history_limit < 0 {
+		invalid = append(invalid, fieldError("strategy.revision_history_limit", "must not be negative"))
+	}
+
+	if deadline := strategy.Progress_deadline_seconds; deadline != nil {
+		minReady := int32(0)
+		if strategy.Min_ready_seconds != nil {
+			minReady = *strategy.Min_ready_seconds
+		}
+		if *deadline <= minReady {
+			invalid = append(invalid, fieldError("strategy.progress_deadline_seconds", "must be greater than min_ready_seconds"))
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	apiErr := NewAPIError(ErrorInvalid, fmt.Sprintf("%d invalid strategy fields", len(invalid)))
+	apiErr.Errors = invalid
+
+	return apiErr
+}
+
+func (model *ModelDeploy) applyStrategy(spec *appsv1.DeploymentSpec) {
+
+	strategy := model.Strategy
+	if strategy == nil {
+		return
+	}
+
+	if appsv1.DeploymentStrategyType(strategy.Type) == appsv1.RecreateDeploymentStrategyType {
+		spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	} else if strategy.Type != "" || strategy.Max_surge != nil || strategy.Max_unavailable != nil {
+		spec.Strategy = appsv1.DeploymentStrategy{
+			Type: appsv1.RollingUpdateDeploymentStrategyType,
+			RollingUpdate: &appsv1.RollingUpdateDeployment{
+				MaxSurge:       strategy.Max_surge,
+				MaxUnavailable: strategy.Max_unavailable,
+			},
+		}
+	}
+
+	if strategy.Min_ready_seconds != nil {
+		spec.MinReadySeconds = *strategy.Min_ready_seconds
+	}
+	spec.ProgressDeadlineSeconds = strategy.Progress_deadline_seconds
+	spec.RevisionHistoryLimit = strategy.Revision_history_limit
+}
+
+// rolloutTimeout is the wait timeout of the request. Without one it waits a
+// little longer than the progress deadline, if that is longer than the
+// default, so a stuck rollout is reported as exceeding its deadline.
+func (model *ModelDeploy) rolloutTimeout() time.Duration {
+
+	timeout := RolloutTimeout(model.Timeout)
+	if model.Timeout != nil || model.Strategy == nil || model.Strategy.Progress_deadline_seconds == nil {
+		return timeout
+	}
+
+	deadline := time.Duration(*model.Strategy.Progress_deadline_seconds)*time.Second + rolloutMargin
+	if deadline > timeout {
+		return deadline
+	}
+
+	return timeout
+}
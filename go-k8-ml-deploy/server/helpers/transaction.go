@@ -0,0 +1,266 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/client-go/kubernetes/typed/apps/v1"
+	hpav2 "k8s.io/client-go/kubernetes/typed/autoscaling/v2"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	ingv1 "k8s.io/client-go/kubernetes/typed/networking/v1"
+	"k8s.io/client-go/util/retry"
+
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	autoscalingv2ac "k8s.io/client-go/applyconfigurations/autoscaling/v2"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	networkingv1ac "k8s.io/client-go/applyconfigurations/networking/v1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+const (
+	RollbackDelete  = "Delete"
+	RollbackRestore = "Restore"
+
+	// rollbackTimeout bounds compensation, which runs on a fresh context so
+	// that it still happens when the request context has expired.
+	rollbackTimeout = 2 * time.Minute
+)
+
+type compensation struct {
+	kind   string
+	name   string
+	action string
+	run    func(ctx context.Context) error
+}
+
+// DeployTransaction records how to undo every change a deploy made so a
+// partial failure can be rolled back.
+type DeployTransaction struct {
+	mu            sync.Mutex
+	compensations []compensation
+}
+
+type StepError struct {
+	Kind      string
+	Name      string
+	Code      string
+	Reason    string `json:",omitempty"`
+	Error     string
+	Conflicts []FieldConflict `json:",omitempty"`
+}
+
+type RollbackResult struct {
+	Kind   string
+	Name   string
+	Action string
+	Error  string
+}
+
+// DeployFailure reports which steps of a deploy failed and what was done to
+// put the endpoint back the way it was.
+type DeployFailure struct {
+	Endpoint    string
+	Failed      []StepError
+	Rolled_back []RollbackResult
+	Complete    bool
+}
+
+func (failure *DeployFailure) Error() string {
+	steps := make([]string, 0, len(failure.Failed))
+	for _, step := range failure.Failed {
+		steps = append(steps, fmt.Sprintf("%s %s: %s", step.Kind, step.Name, step.Error))
+	}
+	return fmt.Sprintf("deploy of %s failed: %s", failure.Endpoint, strings.Join(steps, "; "))
+}
+
+func (tx *DeployTransaction) record(kind, name, action string, run func(ctx context.Context) error) {
+	if tx == nil {
+		return
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	tx.compensations = append(tx.compensations, compensation{kind, name, action, run})
+}
+
+func (tx *DeployTransaction) recordCreate(kind, name string, run func(ctx context.Context) error) {
+	tx.record(kind, name, RollbackDelete, run)
+}
+
+func (tx *DeployTransaction) recordUpdate(kind, name string, run func(ctx context.Context) error) {
+	tx.record(kind, name, RollbackRestore, run)
+}
+
+// Rollback undoes the recorded changes in reverse order. It keeps going when
+// one compensation fails and reports every result. A nil transaction, as used
+// for dry runs, has nothing to undo.
+func (tx *DeployTransaction) Rollback(progress ProgressFunc) ([]RollbackResult, bool) {
+
+	if tx == nil {
+		return make([]RollbackResult, 0), true
+	}
+
+	tx.mu.Lock()
+	compensations := append([]compensation(nil), tx.compensations...)
+	tx.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+
+	results := make([]RollbackResult, 0, len(compensations))
+	complete := true
+
+	for i := len(compensations) - 1; i >= 0; i-- {
+		step := compensations[i]
+		fmt.Printf("Rolling back %s %q (%s)...\n", step.kind, step.name, strings.ToLower(step.action))
+
+		result := RollbackResult{Kind: step.kind, Name: step.name, Action: step.action}
+
+		err := step.run(ctx)
+		if err != nil && !(step.action == RollbackDelete && apierrors.IsNotFound(err)) {
+			result.Error = err.Error()
+			complete = false
+			progress.report(step.kind, step.name, StepFailed, err)
+		} else {
+			progress.report(step.kind, step.name, StepRolledBack, nil)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, complete
+}
+
+// The restore functions put an updated object back to its previous state.
+// Objects this server already applied are restored by re-applying the fields
+// it owned before; older objects get their previous spec written back.
+func restoreDeployment(
+	ctx context.Context, deploymentsClient v1.DeploymentInterface, previous *appsv1.Deployment,
+) error {
+	if ownsApply(previous) {
+		config, err := appsv1ac.ExtractDeployment(previous, FieldManager)
+		if err != nil {
+			return err
+		}
+		_, err = deploymentsClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := deploymentsClient.Get(ctx, previous.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = previous.Labels
+		current.Annotations = previous.Annotations
+		current.Spec = previous.Spec
+		_, err = deploymentsClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreService(
+	ctx context.Context, serviceClient corev1.ServiceInterface, previous *apiv1.Service,
+) error {
+	if ownsApply(previous) {
+		config, err := corev1ac.ExtractService(previous, FieldManager)
+		if err != nil {
+			return err
+		}
+		_, err = serviceClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := serviceClient.Get(ctx, previous.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = previous.Labels
+		current.Annotations = previous.Annotations
+		current.Spec = previous.Spec
+		_, err = serviceClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreIngress(
+	ctx context.Context, ingressClient ingv1.IngressInterface, previous *networkingv1.Ingress,
+) error {
+	if ownsApply(previous) {
+		config, err := networkingv1ac.ExtractIngress(previous, FieldManager)
+		if err != nil {
+			return err
+		}
+		_, err = ingressClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := ingressClient.Get(ctx, previous.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = previous.Labels
+		current.Annotations = previous.Annotations
+		current.Spec = previous.Spec
+		_, err = ingressClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func restoreHpa(
+	ctx context.Context,
+	hpaClient hpav2.HorizontalPodAutoscalerInterface,
+	previous *autoscalingv2.HorizontalPodAutoscaler,
+) error {
+	if ownsApply(previous) {
+		config, err := autoscalingv2ac.ExtractHorizontalPodAutoscaler(previous, FieldManager)
+		if err != nil {
+			return err
+		}
+		_, err = hpaClient.Apply(ctx, config, metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := hpaClient.Get(ctx, previous.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current.Labels = previous.Labels
+		current.Annotations = previous.Annotations
+		current.Spec = previous.Spec
+		_, err = hpaClient.Update(ctx, current, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// recreateHpa puts back an HPA that a deploy deleted.
+func recreateHpa(
+	ctx context.Context,
+	hpaClient hpav2.HorizontalPodAutoscalerInterface,
+	previous *autoscalingv2.HorizontalPodAutoscaler,
+) error {
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        previous.Name,
+			Namespace:   previous.Namespace,
+			Labels:      previous.Labels,
+			Annotations: previous.Annotations,
+		},
+		Spec: previous.Spec,
+	}
+	_, err := hpaClient.Create(ctx, hpa, metav1.CreateOptions{FieldManager: FieldManager})
+	return err
+}
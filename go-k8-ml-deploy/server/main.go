@@ -1,32 +1,93 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 
-	"k8s.io/client-go/rest"
-
 	"server/helpers"
 )
 
+// errorHandler answers every failed request with the JSON error model. Errors
+// raised by fiber itself, such as an unknown route, keep their status code.
+func errorHandler(c *fiber.Ctx, err error) error {
+
+	apiErr := helpers.ClassifyError(err)
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		apiErr = helpers.NewAPIError(helpers.CodeForStatus(fiberErr.Code), fiberErr.Message)
+		apiErr.Status = fiberErr.Code
+	}
+
+	response, respErr := helpers.CreateErrorResponse(apiErr)
+	if respErr != nil {
+		return c.Status(500).SendString(apiErr.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+
+	return c.Status(apiErr.Status).Send(response)
+}
+
+func sendDryRun(c *fiber.Ctx, message *helpers.DryRunReturn, output string) error {
+
+	response, contentType, respErr := helpers.CreateDryRunResponse(message, output)
+	if respErr != nil {
+		return fiber.NewError(400, "Wrong json format")
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+
+	return c.Send(response)
+}
+
 func main() {
 
-	config, err := rest.InClusterConfig()
+	serverConfig, err := helpers.LoadConfig()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	config, clusterInfo, err := helpers.NewKubeConfig(serverConfig)
 	if err != nil {
 		panic(err.Error())
 	}
+	if serverConfig.Namespace == "" {
+		serverConfig.Namespace = clusterInfo.Namespace
+	}
 	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		panic(err.Error())
 	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	helpers.LogClusterIdentity(clientset, clusterInfo)
+
+	operations := helpers.NewOperationManager(
+		serverConfig.Async_workers,
+		serverConfig.Async_queue_size,
+		time.Duration(serverConfig.Operation_timeout)*time.Second,
+	)
+
+	// Manual scales end and schedules apply on their own, also in namespaces
+	// that no request has touched since the server started.
+	namespaceClients := []*helpers.Clients{helpers.NewClients(clientset, dynamicClient, serverConfig.Namespace)}
+	for _, namespace := range serverConfig.Allowed_namespaces {
+		if namespace != serverConfig.Namespace {
+			namespaceClients = append(namespaceClients, helpers.NewClients(clientset, dynamicClient, namespace))
+		}
+	}
+	go helpers.ReconcileScales(context.Background(), namespaceClients, helpers.ScaleReconcileInterval)
 
-	deploymentsClient := clientset.AppsV1().Deployments("namespace")
-	serviceClient := clientset.CoreV1().Services("namespace")
-	ingressClient := clientset.NetworkingV1().Ingresses("namespace")
-	hpaClient := clientset.AutoscalingV2().HorizontalPodAutoscalers("namespace")
-
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: errorHandler})
 
 	app.Post("/deploy", func(c *fiber.Ctx) error {
 
@@ -42,23 +103,85 @@ func main() {
 			return fiber.NewError(400, "Wrong endpoint format")
 		}
 
-		crudChannel := make(chan error, 3)
+		namespace, nsErr := serverConfig.ResolveNamespace(model.Namespace)
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+		model.Namespace = namespace
+		clients := helpers.NewClients(clientset, dynamicClient, namespace)
 
-		go helpers.CrudDeployment(deploymentsClient, model, model_names, endpoint, crudChannel)
-		go helpers.CrudService(serviceClient, model, endpoint, crudChannel)
-		go helpers.CrudIngress(ingressClient, model, endpoint, crudChannel)
+		if resourceErr := serverConfig.ValidateResources(model); resourceErr != nil {
+			return resourceErr
+		}
+		if acceleratorErr := serverConfig.ResolveAccelerator(model); acceleratorErr != nil {
+			return acceleratorErr
+		}
+		serverConfig.ResolveScheduling(model)
+		if envErr := model.ValidateEnv(); envErr != nil {
+			return envErr
+		}
+		if portErr := model.ValidatePorts(endpoint); portErr != nil {
+			return portErr
+		}
+		if artifactErr := serverConfig.ResolveArtifacts(model); artifactErr != nil {
+			return artifactErr
+		}
+		if strategyErr := model.ValidateStrategy(); strategyErr != nil {
+			return strategyErr
+		}
+		if autoscalingErr := serverConfig.ResolveAutoscaling(model); autoscalingErr != nil {
+			return autoscalingErr
+		}
+		if securityErr := serverConfig.ResolveSecurity(model); securityErr != nil {
+			return securityErr
+		}
+		if imageErr := serverConfig.ResolveImage(c.UserContext(), clients, model); imageErr != nil {
+			return imageErr
+		}
+
+		if model.Dry_run {
+			if outputErr := helpers.CheckOutputFormat(model.Output); outputErr != nil {
+				return fiber.NewError(400, outputErr.Error())
+			}
+
+			message, dryRunErr := helpers.DryRunDeploy(c.UserContext(), clients, model, model_names, endpoint)
+			if dryRunErr != nil {
+				return dryRunErr
+			}
+
+			return sendDryRun(c, message, model.Output)
+		}
 
-		errValue, errCheck := helpers.CheckErrors(crudChannel)
-		if errCheck {
-			return fiber.NewError(400, errValue)
+		if model.Async {
+			operation, submitErr := operations.Submit(
+				helpers.Operation{
+					Type:      "deploy",
+					Endpoint:  endpoint,
+					Namespace: namespace,
+					Resources: helpers.DeploySteps(model, endpoint),
+				},
+				func(ctx context.Context, progress helpers.ProgressFunc) (interface{}, error) {
+					return helpers.DeployEndpoint(ctx, clients, model, model_names, endpoint, progress)
+				},
+			)
+			if submitErr != nil {
+				return submitErr
+			}
+
+			response, respErr := helpers.CreateOperationResponse(operation)
+			if respErr != nil {
+				return fiber.NewError(400, "Wrong json format")
+			}
+
+			return c.Status(202).Send(response)
 		}
 
-		errHpa := helpers.CrudHpa(hpaClient, model, endpoint)
-		if errHpa != nil {
-			return fiber.NewError(400, errHpa.Error())
+		message, deployErr := helpers.DeployEndpoint(c.UserContext(), clients, model, model_names, endpoint, nil)
+		if deployErr != nil {
+			return deployErr
 		}
 
-		response, respErr := helpers.CreateResponse(model, endpoint)
+		response, respErr := helpers.CreateResponse(message)
 		if respErr != nil {
 			return fiber.NewError(400, "Wrong json format")
 		}
@@ -76,19 +199,39 @@ func main() {
 
 		err := model.ParseDestroyParams()
 		if err != nil {
-			fiber.NewError(400, "Wrong name")
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(model.Namespace)
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+		model.Namespace = namespace
+		clients := helpers.NewClients(clientset, dynamicClient, namespace)
+
+		if model.Dry_run {
+			if outputErr := helpers.CheckOutputFormat(model.Output); outputErr != nil {
+				return fiber.NewError(400, outputErr.Error())
+			}
+
+			message, dryRunErr := helpers.DryRunDestroy(c.UserContext(), clients, model)
+			if dryRunErr != nil {
+				return dryRunErr
+			}
+
+			return sendDryRun(c, message, model.Output)
 		}
 
-		deleteChannel := make(chan error, 4)
+		deleteChannel := make(chan error, 5)
 
-		go helpers.DeleteDeployment(deploymentsClient, model.Endpoint, deleteChannel)
-		go helpers.DeleteService(serviceClient, model.Endpoint, deleteChannel)
-		go helpers.DeleteIngress(ingressClient, model.Endpoint, deleteChannel)
-		go helpers.DeleteHpa(hpaClient, model.Endpoint, deleteChannel)
+		go helpers.DeleteDeployment(clients.Deployments, model.Endpoint, deleteChannel)
+		go helpers.DeleteService(clients.Services, model.Endpoint, deleteChannel)
+		go helpers.DeleteIngress(clients.Ingresses, model.Endpoint, deleteChannel)
+		go helpers.DeleteHpa(clients.Hpas, model.Endpoint, model.Endpoint, deleteChannel)
+		go helpers.DeleteScaledObject(clients.ScaledObjects, model.Endpoint, model.Endpoint, deleteChannel)
 
-		errValue, errCheck := helpers.CheckErrors(deleteChannel)
-		if errCheck {
-			return fiber.NewError(400, errValue)
+		if deleteErr := helpers.CheckErrors(deleteChannel); deleteErr != nil {
+			return deleteErr
 		}
 
 		response, respErr := helpers.CreateDestroyResponse(model, model.Endpoint)
@@ -113,24 +256,285 @@ func main() {
 			return fiber.NewError(400, "Wrong name")
 		}
 
-		transErr := helpers.TransitionService(serviceClient, model, toDestroy)
+		namespace, nsErr := serverConfig.ResolveNamespace(model.Namespace)
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+		model.Namespace = namespace
+		clients := helpers.NewClients(clientset, dynamicClient, namespace)
+
+		if model.Dry_run {
+			if outputErr := helpers.CheckOutputFormat(model.Output); outputErr != nil {
+				return fiber.NewError(400, outputErr.Error())
+			}
+
+			message, dryRunErr := helpers.DryRunTransition(c.UserContext(), clients, model, toDestroy)
+			if dryRunErr != nil {
+				return dryRunErr
+			}
+
+			return sendDryRun(c, message, model.Output)
+		}
+
+		// Fails on a missing canary before anything is repointed.
+		if scheduleErr := helpers.TransitionSchedules(c.UserContext(), clients, model.Endpoint, toDestroy); scheduleErr != nil {
+			return scheduleErr
+		}
+
+		transErr := helpers.TransitionService(c.UserContext(), clients.Services, model, toDestroy)
 		if transErr != nil {
-			return fiber.NewError(400, transErr.Error())
+			return transErr
+		}
+
+		if hpaErr := helpers.TransitionHpa(c.UserContext(), clients.Hpas, toDestroy); hpaErr != nil {
+			return hpaErr
 		}
 
-		transDeleteChannel := make(chan error, 4)
+		if scaledObjectErr := helpers.TransitionScaledObject(
+			c.UserContext(), clients.ScaledObjects, model.Endpoint, toDestroy,
+		); scaledObjectErr != nil {
+			return scaledObjectErr
+		}
+
+		transDeleteChannel := make(chan error, 5)
+
+		go helpers.DeleteDeployment(clients.Deployments, model.Endpoint, transDeleteChannel)
+		go helpers.DeleteService(clients.Services, toDestroy, transDeleteChannel)
+		go helpers.DeleteIngress(clients.Ingresses, toDestroy, transDeleteChannel)
+		go helpers.DeleteHpa(clients.Hpas, model.Endpoint, model.Endpoint, transDeleteChannel)
+		go helpers.DeleteScaledObject(clients.ScaledObjects, model.Endpoint, model.Endpoint, transDeleteChannel)
+
+		if deleteErr := helpers.CheckErrors(transDeleteChannel); deleteErr != nil {
+			return deleteErr
+		}
+
+		var rollout *helpers.EndpointStatus
+		if model.Wait {
+			status, waitErr := helpers.WaitForRollout(
+				c.UserContext(), clients, model.Endpoint, *model.Canary_version, model.Endpoint,
+				helpers.RolloutTimeout(model.Timeout),
+			)
+			if waitErr != nil {
+				return waitErr
+			}
+			rollout = status
+		}
+
+		response, respErr := helpers.CreateTransResponse(model, rollout)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
 
-		go helpers.DeleteDeployment(deploymentsClient, model.Endpoint, transDeleteChannel)
-		go helpers.DeleteService(serviceClient, toDestroy, transDeleteChannel)
-		go helpers.DeleteIngress(ingressClient, toDestroy, transDeleteChannel)
-		go helpers.DeleteHpa(hpaClient, model.Endpoint, transDeleteChannel)
+		return c.Send(response)
+
+	})
+
+	app.Get("/operations/:id", func(c *fiber.Ctx) error {
+
+		operation, ok := operations.Get(c.Params("id"))
+		if !ok {
+			return fiber.NewError(404, "Operation not found")
+		}
+
+		response, respErr := helpers.CreateOperationStatusResponse(operation)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Get("/endpoints", func(c *fiber.Ctx) error {
+
+		filter := new(helpers.EndpointFilter)
+
+		if parseErr := c.QueryParser(filter); parseErr != nil {
+			return fiber.NewError(400, "Wrong query format")
+		}
+
+		if err := filter.ParseFilterParams(); err != nil {
+			return fiber.NewError(400, "Wrong canary filter")
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(filter.Namespace)
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+
+		list, err := helpers.ListEndpoints(c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), filter)
+		if err != nil {
+			return err
+		}
+
+		response, respErr := helpers.CreateEndpointsResponse(list)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Get("/endpoints/:name/status", func(c *fiber.Ctx) error {
+
+		endpoint, err := helpers.ParseEndpointName(c.Params("name"))
+		if err != nil || endpoint == "" {
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(c.Query("namespace"))
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+
+		status, statusErr := helpers.GetEndpointStatus(
+			c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), endpoint, c.Query("canary_version"),
+		)
+		if statusErr != nil {
+			return statusErr
+		}
+
+		response, respErr := helpers.CreateStatusResponse(status)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		if status.Phase == helpers.PhaseMissing {
+			c.Status(404)
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Post("/endpoints/:name/scale", func(c *fiber.Ctx) error {
+
+		endpoint, err := helpers.ParseEndpointName(c.Params("name"))
+		if err != nil || endpoint == "" {
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		scale := new(helpers.ModelScale)
+
+		if parseErr := c.BodyParser(scale); parseErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		duration, scaleErr := scale.ScaleDuration()
+		if scaleErr != nil {
+			return scaleErr
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(c.Query("namespace"))
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+
+		message, scaleErr := helpers.ScaleEndpoint(
+			c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), endpoint,
+			c.Query("canary_version"), *scale.Replicas, duration,
+		)
+		if scaleErr != nil {
+			return scaleErr
+		}
+
+		response, respErr := helpers.CreateScaleResponse(message)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Post("/endpoints/:name/pause", func(c *fiber.Ctx) error {
+
+		endpoint, err := helpers.ParseEndpointName(c.Params("name"))
+		if err != nil || endpoint == "" {
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(c.Query("namespace"))
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+
+		message, pauseErr := helpers.PauseEndpoint(
+			c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), endpoint, c.Query("canary_version"),
+		)
+		if pauseErr != nil {
+			return pauseErr
+		}
+
+		response, respErr := helpers.CreateScaleResponse(message)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Post("/endpoints/:name/resume", func(c *fiber.Ctx) error {
+
+		endpoint, err := helpers.ParseEndpointName(c.Params("name"))
+		if err != nil || endpoint == "" {
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(c.Query("namespace"))
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
+
+		message, resumeErr := helpers.ResumeEndpoint(
+			c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), endpoint, c.Query("canary_version"),
+		)
+		if resumeErr != nil {
+			return resumeErr
+		}
+
+		response, respErr := helpers.CreateScaleResponse(message)
+		if respErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		return c.Send(response)
+
+	})
+
+	app.Post("/endpoints/:name/schedules", func(c *fiber.Ctx) error {
+
+		endpoint, err := helpers.ParseEndpointName(c.Params("name"))
+		if err != nil || endpoint == "" {
+			return fiber.NewError(400, "Wrong name")
+		}
+
+		schedules := new(helpers.ModelSchedules)
+
+		if parseErr := c.BodyParser(schedules); parseErr != nil {
+			return fiber.NewError(400, "Wrong json format")
+		}
+
+		if scheduleErr := schedules.ValidateSchedules(); scheduleErr != nil {
+			return scheduleErr
+		}
+
+		namespace, nsErr := serverConfig.ResolveNamespace(c.Query("namespace"))
+		if nsErr != nil {
+			return fiber.NewError(403, nsErr.Error())
+		}
 
-		errValue, errCheck := helpers.CheckErrors(transDeleteChannel)
-		if errCheck {
-			return fiber.NewError(400, errValue)
+		message, scheduleErr := helpers.SetSchedules(
+			c.UserContext(), helpers.NewClients(clientset, dynamicClient, namespace), endpoint,
+			c.Query("canary_version"), schedules.Schedules,
+		)
+		if scheduleErr != nil {
+			return scheduleErr
 		}
 
-		response, respErr := helpers.CreateTransResponse(model.Endpoint)
+		response, respErr := helpers.CreateScheduleResponse(message)
 		if respErr != nil {
 			return fiber.NewError(400, "Wrong json format")
 		}